@@ -0,0 +1,119 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/k8scat/shermie-proxy/Core"
+	"github.com/k8scat/shermie-proxy/Utils"
+	"os"
+	"strings"
+	"time"
+)
+
+const caUsage = `usage: shermie-proxy ca <command> [options]
+
+commands:
+  generate  generate a new root certificate
+  rotate    back up the current root certificate and generate a new one
+  export    export the root certificate as pem, der, p12 or mobileconfig
+  install   install the root certificate into the system trust store
+  uninstall remove the root certificate from the system trust store
+`
+
+// 处理根证书管理命令,返回进程退出码
+func CaCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, caUsage)
+		return 2
+	}
+	flags := flag.NewFlagSet("ca "+args[0], flag.ContinueOnError)
+	certFile := flags.String("cert", "./cert.crt", "root certificate file")
+	keyFile := flags.String("key", "./cert.key", "root certificate private key file")
+	cert := Core.NewCertificate()
+	var err error
+	switch args[0] {
+	case "generate", "rotate":
+		options := Core.DefaultRootOptions()
+		flags.StringVar(&options.CommonName, "cn", options.CommonName, "subject common name")
+		flags.StringVar(&options.Organization, "org", options.Organization, "subject organization")
+		flags.StringVar(&options.Country, "country", options.Country, "subject country")
+		days := flags.Int("days", int(options.Validity/(time.Hour*24)), "validity in days")
+		keyType := flags.String("key-type", "rsa", "key type, rsa or ecdsa")
+		force := flags.Bool("force", false, "overwrite existing files when generating")
+		if flags.Parse(args[1:]) != nil {
+			return 2
+		}
+		cert.CertFile, cert.KeyFile = *certFile, *keyFile
+		options.Validity = time.Duration(*days) * time.Hour * 24
+		switch strings.ToLower(*keyType) {
+		case "rsa":
+			options.KeyType = Core.LeafKeyRsa
+		case "ecdsa":
+			options.KeyType = Core.LeafKeyEcdsa
+		default:
+			fmt.Fprintln(os.Stderr, "不支持的密钥类型："+*keyType)
+			return 2
+		}
+		if args[0] == "rotate" {
+			err = cert.Rotate(options)
+			break
+		}
+		if !*force && (Utils.FileExist(cert.CertFile) || Utils.FileExist(cert.KeyFile)) {
+			fmt.Fprintln(os.Stderr, "根证书已存在，使用-force覆盖或使用rotate轮换："+cert.CertFile)
+			return 1
+		}
+		err = cert.GenerateRoot(options)
+		if err == nil {
+			err = cert.Load()
+		}
+	case "export":
+		format := flags.String("format", Core.ExportPem, "pem, der, p12 or mobileconfig")
+		out := flags.String("out", "", "output file, stdout when empty")
+		password := flags.String("password", "", "p12 password")
+		if flags.Parse(args[1:]) != nil {
+			return 2
+		}
+		cert.CertFile, cert.KeyFile = *certFile, *keyFile
+		err = cert.Load()
+		if err != nil {
+			break
+		}
+		var data []byte
+		data, err = cert.Export(*format, *password)
+		if err != nil {
+			break
+		}
+		if *out == "" {
+			_, err = os.Stdout.Write(data)
+			break
+		}
+		err = os.WriteFile(*out, data, 0644)
+	case "install", "uninstall":
+		flags.StringVar(&Utils.SystemRoot, "root", Utils.SystemRoot, "system root directory")
+		flags.BoolVar(&Utils.DryRun, "dry-run", Utils.DryRun, "only write files, do not run update commands")
+		flags.StringVar(&Utils.CertName, "name", Utils.CertName, "certificate name in the trust store")
+		if flags.Parse(args[1:]) != nil {
+			return 2
+		}
+		if args[0] == "uninstall" {
+			err = Utils.UninstallCert()
+		} else {
+			err = Utils.InstallCert(*certFile)
+		}
+		if err != nil {
+			break
+		}
+		fmt.Fprintln(os.Stderr, "已更新系统证书")
+		return 0
+	default:
+		fmt.Fprint(os.Stderr, caUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "subject: %s\nexpires: %s\nsha256: %s\n",
+		cert.RootCa.Subject.String(), cert.RootCa.NotAfter.Format(time.RFC3339), cert.Fingerprint())
+	return 0
+}
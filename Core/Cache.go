@@ -1,65 +1,275 @@
 package Core
 
 import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"net"
+	"os"
+	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/k8scat/shermie-proxy/Log"
 )
 
 var Cache = NewStorage()
 
 type action struct {
-	wg     *sync.WaitGroup
-	fn     func() (interface{}, error)
-	cert   interface{}
-	forget bool
-	err    error
+	wg      *sync.WaitGroup
+	fn      func() (interface{}, error)
+	cert    interface{}
+	forget  bool
+	err     error
+	done    bool
+	issued  time.Time
+	expire  time.Time
+	key     string
+	element *list.Element
 }
 
 type Storage struct {
 	lock    *sync.Mutex
 	mapping map[string]*action
+	// 按最近使用排序,超出MaxEntries时淘汰最久未使用的证书
+	lru *list.List
+	// 证书保存目录,为空时只缓存在内存中
+	Dir string
+	// 证书过期前多久重新生成,有效期较短的证书(如仿照远程服务器生成的证书)最多提前三分之一有效期
+	RefreshBefore time.Duration
+	// 内存中最多缓存的证书数量
+	MaxEntries int
+	hits       int64
+	misses     int64
+	evictions  int64
+	errors     int64
+}
+
+// 证书缓存统计数据
+type CacheStats struct {
+	Entries   int
+	Hits      int64
+	Misses    int64
+	Evictions int64
+	Errors    int64
 }
 
 func NewStorage() *Storage {
 	return &Storage{
-		lock:    &sync.Mutex{},
-		mapping: map[string]*action{},
+		lock:          &sync.Mutex{},
+		mapping:       map[string]*action{},
+		lru:           list.New(),
+		RefreshBefore: time.Hour * 24 * 7,
+		MaxEntries:    10000,
+	}
+}
+
+func (i *Storage) Stats() CacheStats {
+	i.lock.Lock()
+	entries := len(i.mapping)
+	i.lock.Unlock()
+	return CacheStats{
+		Entries:   entries,
+		Hits:      atomic.LoadInt64(&i.hits),
+		Misses:    atomic.LoadInt64(&i.misses),
+		Evictions: atomic.LoadInt64(&i.evictions),
+		Errors:    atomic.LoadInt64(&i.errors),
+	}
+}
+
+// 加入缓存并淘汰超出数量的证书,调用时需要持有锁
+func (i *Storage) add(item *action) {
+	if old, exist := i.mapping[item.key]; exist {
+		i.lru.Remove(old.element)
+	}
+	item.element = i.lru.PushFront(item)
+	i.mapping[item.key] = item
+	for i.MaxEntries > 0 && i.lru.Len() > i.MaxEntries {
+		i.remove(i.lru.Back().Value.(*action))
+		atomic.AddInt64(&i.evictions, 1)
 	}
 }
 
-func (i *Storage) do(action *action, callback func() (interface{}, error)) {
+// 移除缓存,调用时需要持有锁
+func (i *Storage) remove(item *action) {
+	if i.mapping[item.key] != item {
+		return
+	}
+	i.lru.Remove(item.element)
+	delete(i.mapping, item.key)
+}
+
+// 清空内存中的证书,根证书变化后调用
+func (i *Storage) Clear() {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.mapping = map[string]*action{}
+	i.lru.Init()
+}
+
+// 证书是否需要重新生成
+func (i *action) expiring(before time.Duration) bool {
+	return i.done && !i.expire.IsZero() && time.Until(i.expire) < refreshWindow(before, i.issued, i.expire)
+}
+
+// 过期前重新生成的时间窗口,不超过证书有效期的三分之一
+func refreshWindow(before time.Duration, issued time.Time, expire time.Time) time.Duration {
+	return min(before, expire.Sub(issued)/3)
+}
+
+func (i *Storage) do(key string, action *action, callback func() (interface{}, error)) {
 	defer func() {
 		action.wg.Done()
 	}()
-	action.cert, action.err = callback()
+	cert, err := callback()
+	var issued, expire time.Time
+	if certificate, ok := cert.(tls.Certificate); ok && err == nil {
+		if leaf, parseErr := x509.ParseCertificate(certificate.Certificate[0]); parseErr == nil {
+			issued, expire = leaf.NotBefore, leaf.NotAfter
+		}
+		i.save(key, certificate)
+	}
+	i.lock.Lock()
+	action.cert, action.err = cert, err
+	action.issued, action.expire = issued, expire
+	action.done = true
+	// 生成失败的证书不缓存,下次请求时重试
+	if err != nil {
+		i.remove(action)
+		atomic.AddInt64(&i.errors, 1)
+	}
+	i.lock.Unlock()
 }
 
-func (i *Storage) GetCertificate(hostname string, port string) (interface{}, error) {
+// 从目录加载之前生成的证书,根证书变化或即将过期的证书会被忽略
+func (i *Storage) Load(dir string) error {
+	if Cert == nil || Cert.RootCa == nil {
+		return errors.New("根证书未初始化")
+	}
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return fmt.Errorf("创建证书目录失败：%w", err)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return fmt.Errorf("读取证书目录失败：%w", err)
+	}
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.Dir = dir
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		// 第一行为证书对应的key,pem解析时会忽略
+		line, _, _ := bytes.Cut(content, []byte("\n"))
+		key := strings.TrimPrefix(string(line), "Host: ")
+		if key == string(line) {
+			continue
+		}
+		certificate, err := tls.X509KeyPair(content, content)
+		if err != nil {
+			continue
+		}
+		leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+		if err != nil || leaf.CheckSignatureFrom(Cert.RootCa) != nil || time.Until(leaf.NotAfter) < refreshWindow(i.RefreshBefore, leaf.NotBefore, leaf.NotAfter) {
+			_ = os.Remove(file)
+			continue
+		}
+		i.add(&action{
+			wg:     &sync.WaitGroup{},
+			cert:   certificate,
+			done:   true,
+			issued: leaf.NotBefore,
+			expire: leaf.NotAfter,
+			key:    key,
+		})
+	}
+	return nil
+}
+
+// 将证书写入目录,文件名为key的哈希值,key保存在文件第一行
+func (i *Storage) save(key string, certificate tls.Certificate) {
+	// Dir由Load在锁内设置,读取时同样需要加锁
 	i.lock.Lock()
-	if strings.Index(hostname, ":") == -1 {
-		hostname += ":" + port
+	dir := i.Dir
+	i.lock.Unlock()
+	if dir == "" {
+		return
 	}
-	host, _, err := net.SplitHostPort(hostname)
+	signer, ok := certificate.PrivateKey.(crypto.Signer)
+	if !ok {
+		return
+	}
+	keyBlock, err := MarshalPrivateKey(signer)
+	if err != nil {
+		return
+	}
+	buffer := bytes.NewBufferString("Host: " + key + "\n")
+	_ = pem.Encode(buffer, &pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: certificate.Certificate[0],
+	})
+	_ = pem.Encode(buffer, keyBlock)
+	sum := sha256.Sum256([]byte(key))
+	file := filepath.Join(dir, hex.EncodeToString(sum[:16])+".pem")
+	err = os.WriteFile(file, buffer.Bytes(), 0600)
 	if err != nil {
-		return nil, err
+		Log.Log.Println("保存证书失败：" + err.Error())
+	}
+}
+
+func (i *Storage) GetCertificate(hostname string, port string) (interface{}, error) {
+	// hostname可以是域名、ip(包括不带端口的ipv6地址)或者带端口的地址
+	host := strings.Trim(hostname, "[]")
+	if net.ParseIP(host) == nil && strings.Contains(hostname, ":") {
+		var err error
+		host, _, err = net.SplitHostPort(hostname)
+		if err != nil {
+			return nil, err
+		}
 	}
-	// 对相同域名的并发,同一时刻只生成一个证书
-	if action, exist := i.mapping[host]; exist {
+	return i.get(host, GetAction(host))
+}
+
+// 获取仿照远程服务器证书生成的证书,address为远程服务器地址,host为SNI
+func (i *Storage) GetMimicCertificate(host string, address string, dial func(ctx context.Context, network, addr string) (net.Conn, error)) (interface{}, error) {
+	return i.get("mimic|"+host+"|"+address, GetMimicAction(host, address, dial))
+}
+
+func (i *Storage) get(key string, fn func() (interface{}, error)) (interface{}, error) {
+	i.lock.Lock()
+	// 对相同域名的并发,同一时刻只生成一个证书,等待的请求会得到相同的结果
+	if item, exist := i.mapping[key]; exist && !item.expiring(i.RefreshBefore) {
+		i.lru.MoveToFront(item.element)
 		i.lock.Unlock()
-		action.wg.Wait()
-		return action.cert, nil
+		atomic.AddInt64(&i.hits, 1)
+		item.wg.Wait()
+		return item.cert, item.err
 	}
+	atomic.AddInt64(&i.misses, 1)
 	// 对不同的域名的并发,同一时刻只生成一个域名处理对象
-	i.mapping[host] = &action{
-		wg: &sync.WaitGroup{},
-		fn: GetAction(host),
+	item := &action{
+		wg:  &sync.WaitGroup{},
+		fn:  fn,
+		key: key,
 	}
-	i.mapping[host].wg.Add(1)
+	item.wg.Add(1)
+	i.add(item)
 	i.lock.Unlock()
-	i.do(i.mapping[host], i.mapping[host].fn)
-	return i.mapping[host].cert, i.mapping[host].err
+	i.do(key, item, item.fn)
+	return item.cert, item.err
 }
 
 func GetAction(hostname string) func() (interface{}, error) {
@@ -75,3 +285,35 @@ func GetAction(hostname string) func() (interface{}, error) {
 		return certificate, nil
 	}
 }
+
+// 连接远程服务器读取证书,再仿照该证书生成子证书
+func GetMimicAction(host string, address string, dial func(ctx context.Context, network, addr string) (net.Conn, error)) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+		conn, err := dial(ctx, "tcp", address)
+		if err != nil {
+			return nil, fmt.Errorf("连接远程服务器失败：%w", err)
+		}
+		sslConn := tls.Client(conn, &tls.Config{
+			ServerName:         host,
+			InsecureSkipVerify: true,
+		})
+		defer func() {
+			_ = sslConn.Close()
+		}()
+		err = sslConn.HandshakeContext(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("读取远程服务器证书失败：%w", err)
+		}
+		certificates := sslConn.ConnectionState().PeerCertificates
+		if len(certificates) == 0 {
+			return nil, errors.New("远程服务器没有返回证书")
+		}
+		cert, privateKey, err := Cert.GenerateMimicPem(certificates[0])
+		if err != nil {
+			return nil, err
+		}
+		return tls.X509KeyPair(cert, privateKey)
+	}
+}
@@ -0,0 +1,186 @@
+package Core
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/k8scat/shermie-proxy/Log"
+)
+
+// 证书下载页面
+var portalTemplate = template.Must(template.New("portal").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Shermie Proxy Root Certificate</title>
+<style>
+body{font-family:-apple-system,"Segoe UI",Roboto,"PingFang SC",sans-serif;max-width:760px;margin:0 auto;padding:16px;color:#222;line-height:1.5}
+code{font-size:13px;word-break:break-all;background:#f4f4f4;padding:1px 4px}
+table{border-collapse:collapse}td{padding:4px 12px 4px 0;vertical-align:top}
+.download a{display:inline-block;margin:4px 8px 4px 0;padding:6px 12px;border:1px solid #888;border-radius:4px;text-decoration:none;color:#222}
+h2{margin-top:28px;border-bottom:1px solid #ddd}
+</style>
+</head>
+<body>
+<h1>Shermie Proxy Root Certificate</h1>
+<table>
+<tr><td>Subject</td><td><code>{{.Subject}}</code></td></tr>
+<tr><td>Expires</td><td><code>{{.NotAfter}}</code></td></tr>
+<tr><td>SHA-256</td><td><code>{{.Sha256}}</code></td></tr>
+<tr><td>SHA-1</td><td><code>{{.Sha1}}</code></td></tr>
+</table>
+<p>Compare the fingerprint with the one printed by <code>shermie-proxy ca export</code> before trusting the certificate.</p>
+<div class="download">
+<a href="/cert.pem">PEM (.pem)</a>
+<a href="/cert.crt">DER (.crt)</a>
+<a href="/cert.p12">PKCS#12 (.p12)</a>
+<a href="/cert.mobileconfig">iOS / macOS profile (.mobileconfig)</a>
+</div>
+
+<h2>Windows</h2>
+<ol>
+<li>Download <a href="/cert.crt">cert.crt</a> and open it, choose <b>Install Certificate</b>.</li>
+<li>Select <b>Local Machine</b>, then <b>Place all certificates in the following store</b> and choose <b>Trusted Root Certification Authorities</b>.</li>
+<li>Or run <code>certutil -addstore -f Root cert.crt</code> as administrator.</li>
+</ol>
+
+<h2>macOS</h2>
+<ol>
+<li>Download <a href="/cert.pem">cert.pem</a> and open it to add it to the <b>System</b> keychain.</li>
+<li>In Keychain Access open the certificate, expand <b>Trust</b> and set <b>When using this certificate</b> to <b>Always Trust</b>.</li>
+<li>Or run <code>sudo security add-trusted-cert -d -r trustRoot -k /Library/Keychains/System.keychain cert.pem</code>.</li>
+</ol>
+
+<h2>iOS / iPadOS</h2>
+<ol>
+<li>Open this page in Safari and download the <a href="/cert.mobileconfig">profile</a>.</li>
+<li>Install it in <b>Settings &gt; General &gt; VPN &amp; Device Management</b>.</li>
+<li>Enable full trust in <b>Settings &gt; General &gt; About &gt; Certificate Trust Settings</b>.</li>
+</ol>
+
+<h2>Android</h2>
+<ol>
+<li>Download <a href="/cert.crt">cert.crt</a>.</li>
+<li>Install it in <b>Settings &gt; Security &gt; Encryption &amp; credentials &gt; Install a certificate &gt; CA certificate</b>.</li>
+<li>Apps targeting Android 7 or later only trust user certificates when their network security config allows it.</li>
+</ol>
+
+<h2>Linux</h2>
+<ol>
+<li>Run <code>shermie-proxy ca install</code> on the proxy host, it writes the system trust store and the Firefox / Chrome NSS databases.</li>
+<li>Debian / Ubuntu: copy <a href="/cert.pem">cert.pem</a> to <code>/usr/local/share/ca-certificates/shermie-proxy.crt</code> and run <code>sudo update-ca-certificates</code>.</li>
+<li>RHEL / Fedora: copy it to <code>/etc/pki/ca-trust/source/anchors/</code> and run <code>sudo update-ca-trust extract</code>.</li>
+<li>Arch: run <code>sudo trust anchor --store cert.pem</code>.</li>
+</ol>
+
+<h2>Firefox</h2>
+<ol>
+<li>Open <b>Settings &gt; Privacy &amp; Security &gt; Certificates &gt; View Certificates &gt; Authorities</b>.</li>
+<li>Import <a href="/cert.pem">cert.pem</a> and check <b>Trust this CA to identify websites</b>.</li>
+</ol>
+
+<h2>Chrome / Edge</h2>
+<ol>
+<li>Windows and macOS use the system store, follow the steps above.</li>
+<li>On Linux import <a href="/cert.pem">cert.pem</a> in <code>chrome://certificate-manager</code> under <b>Custom &gt; Installed by you</b>, or run <code>certutil -d sql:$HOME/.pki/nssdb -A -t "C,," -n shermie-proxy -i cert.pem</code>.</li>
+</ol>
+</body>
+</html>
+`))
+
+// 是否为证书页面的请求,包括访问SslFileHost和直接访问监听端口的请求
+func (i *ProxyHttp) isPortalRequest() bool {
+	hostname := i.request.Host
+	if host, _, err := net.SplitHostPort(hostname); err == nil {
+		hostname = host
+	}
+	if strings.EqualFold(hostname, SslFileHost) {
+		return true
+	}
+	// 代理请求使用绝对地址,隧道外的相对地址说明是直接访问监听端口
+	return !i.tls && i.tunnel == "" && i.request.URL.Host == ""
+}
+
+// 处理证书页面请求,返回连接是否可以继续复用
+func (i *ProxyHttp) servePortal(keepAlive bool) bool {
+	status, header, body := i.portalResponse()
+	response := http.Response{
+		StatusCode:    status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         !keepAlive,
+	}
+	if i.request.Method == http.MethodHead {
+		response.Body = nil
+	}
+	return response.Write(i.conn) == nil && keepAlive
+}
+
+// 在http2流中返回证书页面
+func (i *ProxyHttp) servePortalHttp2(writer http.ResponseWriter) {
+	status, header, body := i.portalResponse()
+	for key, value := range header {
+		writer.Header()[key] = value
+	}
+	writer.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	writer.WriteHeader(status)
+	if i.request.Method != http.MethodHead {
+		_, _ = writer.Write(body)
+	}
+}
+
+// 按请求路径生成证书页面或证书文件
+func (i *ProxyHttp) portalResponse() (int, http.Header, []byte) {
+	header := http.Header{"Cache-Control": []string{"no-store"}}
+	path := i.request.URL.Path
+	switch {
+	case path == "/" || path == "":
+		sha1Sum := sha1.Sum(Cert.RootCaStr)
+		buff := &bytes.Buffer{}
+		err := portalTemplate.Execute(buff, map[string]string{
+			"Subject":  Cert.RootCa.Subject.String(),
+			"NotAfter": Cert.RootCa.NotAfter.Format(time.RFC3339),
+			"Sha256":   Cert.Fingerprint(),
+			"Sha1":     formatFingerprint(sha1Sum[:]),
+		})
+		if err != nil {
+			Log.Log.Println("生成证书页面失败：" + err.Error())
+			return http.StatusInternalServerError, header, nil
+		}
+		header.Set("Content-Type", "text/html; charset=utf-8")
+		return http.StatusOK, header, buff.Bytes()
+	case path == "/tls" || strings.HasPrefix(path, "/cert."):
+		// /tls默认返回der格式,可以通过format参数指定其他导出格式
+		format := i.request.URL.Query().Get("format")
+		for name, item := range ExportFormats {
+			if path == "/cert"+item[0] {
+				format = name
+			}
+		}
+		if _, ok := ExportFormats[format]; !ok {
+			format = ExportDer
+		}
+		body, err := Cert.Export(format, i.request.URL.Query().Get("password"))
+		if err != nil {
+			Log.Log.Println("导出根证书失败：" + err.Error())
+			return http.StatusInternalServerError, header, nil
+		}
+		header.Set("Content-Type", ExportFormats[format][1])
+		header.Set("Content-Disposition", "attachment;filename=cert"+ExportFormats[format][0])
+		header.Set("Content-Transfer-Encoding", "binary")
+		return http.StatusOK, header, body
+	}
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	return http.StatusNotFound, header, []byte("404 page not found\n")
+}
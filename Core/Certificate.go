@@ -1,6 +1,9 @@
 package Core
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
@@ -8,49 +11,94 @@ import (
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"github.com/k8scat/shermie-proxy/Log"
 	"github.com/k8scat/shermie-proxy/Utils"
 	"math/big"
 	"net"
 	"os"
+	"sync"
 	"time"
 )
 
 var Cert *Certificate
 
+const (
+	LeafKeyRsa = iota
+	LeafKeyEcdsa
+)
+
 type Certificate struct {
-	RootKey    *rsa.PrivateKey
+	RootKey    crypto.Signer
 	RootCa     *x509.Certificate
 	RootCaStr  []byte
 	RootKeyStr []byte
+	// 根证书和私钥文件路径
+	CertFile string
+	KeyFile  string
+	// 子证书密钥类型,LeafKeyRsa或LeafKeyEcdsa(P-256)
+	LeafKey int
+	// 所有子证书使用同一个密钥对,避免每个域名都生成密钥
+	ReuseLeafKey bool
+	leafLock     *sync.Mutex
+	leafKey      crypto.Signer
 }
 
 func NewCertificate() *Certificate {
 	return &Certificate{
-		RootKey: nil,
-		RootCa:  nil,
+		RootKey:  nil,
+		RootCa:   nil,
+		CertFile: "./cert.crt",
+		KeyFile:  "./cert.key",
+		leafLock: &sync.Mutex{},
 	}
 }
 
-// 初始化根证书
+// 生成根证书的参数
+type RootOptions struct {
+	CommonName   string
+	Organization string
+	Country      string
+	// 有效期
+	Validity time.Duration
+	// LeafKeyRsa或LeafKeyEcdsa
+	KeyType int
+}
+
+func DefaultRootOptions() RootOptions {
+	return RootOptions{
+		CommonName:   "Shermie",
+		Organization: "company",
+		Country:      "CN",
+		Validity:     time.Hour * 24 * 365 * 2,
+		KeyType:      LeafKeyRsa,
+	}
+}
+
+// 初始化根证书,根证书不存在时使用默认参数生成
 func (i *Certificate) Init() error {
-	var err error
-	var certBlock, keyBlock *pem.Block
-	certFile := "./cert.crt"
-	keyFile := "./cert.key"
-	// 如果根证书不存在,则生成
-	if !Utils.FileExist(certFile) {
-		// 生成根pem文件
-		certBlock, keyBlock, err = i.GenerateRootPemFile("Shermie")
+	if !Utils.FileExist(i.CertFile) {
+		err := i.GenerateRoot(DefaultRootOptions())
 		if err != nil {
 			return fmt.Errorf("生成根证书文件失败：%w", err)
 		}
-	} else {
-		// 读取文件内容
-		certFileByte, _ := os.ReadFile(certFile)
-		keyFileByte, _ := os.ReadFile(keyFile)
-		// 根证书存在,则使用
-		certBlock, _ = pem.Decode(certFileByte)
-		keyBlock, _ = pem.Decode(keyFileByte)
+	}
+	return i.Load()
+}
+
+// 从文件加载根证书
+func (i *Certificate) Load() error {
+	certFileByte, err := os.ReadFile(i.CertFile)
+	if err != nil {
+		return fmt.Errorf("读取根证书失败：%w", err)
+	}
+	keyFileByte, err := os.ReadFile(i.KeyFile)
+	if err != nil {
+		return fmt.Errorf("读取根证书私钥失败：%w", err)
+	}
+	certBlock, _ := pem.Decode(certFileByte)
+	keyBlock, _ := pem.Decode(keyFileByte)
+	if certBlock == nil || keyBlock == nil {
+		return errors.New("根证书格式错误")
 	}
 	i.RootKeyStr = keyBlock.Bytes
 	i.RootCaStr = certBlock.Bytes
@@ -58,7 +106,7 @@ func (i *Certificate) Init() error {
 	if err != nil {
 		return fmt.Errorf("初始化根根证书失败：%w", err)
 	}
-	i.RootKey, err = x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	i.RootKey, err = ParsePrivateKey(keyBlock)
 	if err != nil {
 		return fmt.Errorf("初始化根根证书私钥失败：%w", err)
 	}
@@ -66,62 +114,130 @@ func (i *Certificate) Init() error {
 	return nil
 }
 
-// 用根证书生成新的子证书
-func (i *Certificate) GeneratePem(host string) ([]byte, []byte, error) {
-	max := new(big.Int).Lsh(big.NewInt(1), 128)   // 把 1 左移 128 位，返回给 big.Int
-	serialNumber, _ := rand.Int(rand.Reader, max) // 返回在 [0, max) 区间均匀随机分布的一个随机值
+// 生成新的根证书并写入CertFile、KeyFile
+func (i *Certificate) GenerateRoot(options RootOptions) error {
+	return i.generateRoot(options, i.CertFile, i.KeyFile)
+}
+
+func (i *Certificate) generateRoot(options RootOptions, certFile string, keyFile string) error {
+	max := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, _ := rand.Int(rand.Reader, max)
 	template := x509.Certificate{
-		SerialNumber: serialNumber, // SerialNumber 是 CA 颁布的唯一序列号，在此使用一个大随机数来代表它
-		Subject: pkix.Name{ // Name代表一个X.509识别名。只包含识别名的公共属性，额外的属性被忽略。
-			Country:            []string{"CN"},         // 证书所属的国家
-			Organization:       []string{"company"},    // 证书存放的公司名称
-			OrganizationalUnit: []string{"department"}, // 证书所属的部门名称
-			Province:           []string{"BeiJing"},    // 证书签发机构所在省
-			CommonName:         host,
-			Locality:           []string{"BeiJing"}, // 证书签发机构所在市
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Country:      []string{options.Country},      // 证书所属的国家
+			Organization: []string{options.Organization}, // 证书存放的公司名称
+			CommonName:   options.CommonName,
 		},
-		NotBefore:             time.Now().AddDate(-1, 0, 0),
-		NotAfter:              time.Now().AddDate(1, 0, 0),
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(options.Validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		EmailAddresses:        []string{"forward.nice.cp@gmail.com"},
 		BasicConstraintsValid: true,
 		IsCA:                  true,
-		Issuer: pkix.Name{
-			CommonName: host,
-		},
 	}
-	if ip := net.ParseIP(host); ip != nil {
-		template.IPAddresses = []net.IP{ip}
+	var priKey crypto.Signer
+	var err error
+	if options.KeyType == LeafKeyEcdsa {
+		priKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	} else {
-		template.DNSNames = []string{host}
+		priKey, err = i.GenerateKeyPair()
 	}
-	priKey, err := i.GenerateKeyPair()
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
-	cert, err := x509.CreateCertificate(rand.Reader, &template, i.RootCa, &priKey.PublicKey, i.RootKey)
+	cert, err := x509.CreateCertificate(rand.Reader, &template, &template, priKey.Public(), priKey)
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
-	certBlock := &pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: cert,
+	keyBlock, err := MarshalPrivateKey(priKey)
+	if err != nil {
+		return err
+	}
+	// 私钥只允许当前用户读取
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(keyBlock), 0600)
+	if err != nil {
+		return fmt.Errorf("写入根证书私钥失败：%w", err)
 	}
-	priKeyBlock := &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(priKey),
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0644)
+	if err != nil {
+		return fmt.Errorf("写入根证书失败：%w", err)
 	}
-	return pem.EncodeToMemory(certBlock), pem.EncodeToMemory(priKeyBlock), err
+	return nil
 }
 
-// 生成新的根证书
-func (i *Certificate) GenerateRootPemFile(host string) (*pem.Block, *pem.Block, error) {
-	max := new(big.Int).Lsh(big.NewInt(1), 128)
-	serialNumber, _ := rand.Int(rand.Reader, max)
-	template := x509.Certificate{
-		SerialNumber: serialNumber,
-		Subject: pkix.Name{
+// 轮换根证书,旧证书备份为带时间的.bak文件,之前签发的子证书全部失效
+func (i *Certificate) Rotate(options RootOptions) error {
+	// 先生成到临时文件,生成失败时旧证书保持不变
+	files := []string{i.KeyFile, i.CertFile}
+	temps := []string{i.KeyFile + ".new", i.CertFile + ".new"}
+	err := i.generateRoot(options, temps[1], temps[0])
+	if err != nil {
+		for _, temp := range temps {
+			_ = os.Remove(temp)
+		}
+		return err
+	}
+	suffix := "." + time.Now().Format("20060102150405")
+	// 任一步失败时从备份恢复私钥和证书,避免新私钥和旧证书不匹配导致无法启动
+	backups := make([]string, len(files))
+	replaced := make([]bool, len(files))
+	rollback := func() {
+		for n, file := range files {
+			if replaced[n] {
+				_ = os.Remove(file)
+			}
+			if backups[n] != "" {
+				if err := os.Rename(backups[n], file); err != nil {
+					Log.Log.Println("恢复旧根证书失败：" + err.Error())
+				}
+			}
+			_ = os.Remove(temps[n])
+		}
+	}
+	for n, file := range files {
+		if Utils.FileExist(file) {
+			backup := file + suffix + ".bak"
+			for k := 1; Utils.FileExist(backup); k++ {
+				backup = fmt.Sprintf("%s%s-%d.bak", file, suffix, k)
+			}
+			err = os.Rename(file, backup)
+			if err != nil {
+				rollback()
+				return fmt.Errorf("备份根证书失败：%w", err)
+			}
+			backups[n] = backup
+		}
+		err = os.Rename(temps[n], file)
+		if err != nil {
+			rollback()
+			return fmt.Errorf("替换根证书失败：%w", err)
+		}
+		replaced[n] = true
+	}
+	err = i.Load()
+	if err != nil {
+		rollback()
+		// 重新加载旧根证书,恢复可能被部分修改的字段
+		_ = i.Load()
+		return err
+	}
+	for _, backup := range backups {
+		if backup != "" {
+			Log.Log.Println("旧根证书已备份：" + backup)
+		}
+	}
+	i.leafLock.Lock()
+	i.leafKey = nil
+	i.leafLock.Unlock()
+	Cache.Clear()
+	return nil
+}
+
+// 用根证书生成新的子证书
+func (i *Certificate) GeneratePem(host string) ([]byte, []byte, error) {
+	template := &x509.Certificate{
+		Subject: pkix.Name{ // Name代表一个X.509识别名。只包含识别名的公共属性，额外的属性被忽略。
 			Country:            []string{"CN"},         // 证书所属的国家
 			Organization:       []string{"company"},    // 证书存放的公司名称
 			OrganizationalUnit: []string{"department"}, // 证书所属的部门名称
@@ -129,52 +245,144 @@ func (i *Certificate) GenerateRootPemFile(host string) (*pem.Block, *pem.Block,
 			CommonName:         host,
 			Locality:           []string{"BeiJing"}, // 证书签发机构所在市
 		},
-		NotBefore:             time.Now().AddDate(-1, 0, 0),
-		NotAfter:              time.Now().AddDate(1, 0, 0),
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		EmailAddresses:        []string{"forward.nice.cp@gmail.com"},
-		BasicConstraintsValid: true,
-		IsCA:                  true,
-		Issuer: pkix.Name{
-			CommonName: host,
-		},
+		NotBefore:      time.Now().AddDate(-1, 0, 0),
+		NotAfter:       time.Now().AddDate(1, 0, 0),
+		EmailAddresses: []string{"forward.nice.cp@gmail.com"},
 	}
 	if ip := net.ParseIP(host); ip != nil {
 		template.IPAddresses = []net.IP{ip}
 	} else {
 		template.DNSNames = []string{host}
 	}
-	priKey, err := i.GenerateKeyPair()
+	return i.signLeaf(template)
+}
+
+// 仿照远程服务器的证书生成子证书,复制主题、SAN和有效期,由根证书签发
+func (i *Certificate) GenerateMimicPem(upstream *x509.Certificate) ([]byte, []byte, error) {
+	template := &x509.Certificate{
+		RawSubject:     upstream.RawSubject,
+		NotBefore:      upstream.NotBefore,
+		NotAfter:       upstream.NotAfter,
+		DNSNames:       upstream.DNSNames,
+		IPAddresses:    upstream.IPAddresses,
+		EmailAddresses: upstream.EmailAddresses,
+		URIs:           upstream.URIs,
+	}
+	return i.signLeaf(template)
+}
+
+// 签发子证书,子证书不能作为CA使用
+func (i *Certificate) signLeaf(template *x509.Certificate) ([]byte, []byte, error) {
+	max := new(big.Int).Lsh(big.NewInt(1), 128)   // 把 1 左移 128 位，返回给 big.Int
+	serialNumber, _ := rand.Int(rand.Reader, max) // 返回在 [0, max) 区间均匀随机分布的一个随机值
+	template.SerialNumber = serialNumber          // SerialNumber 是 CA 颁布的唯一序列号，在此使用一个大随机数来代表它
+	template.KeyUsage = x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	template.BasicConstraintsValid = true
+	template.IsCA = false
+	priKey, err := i.GenerateLeafKey()
 	if err != nil {
 		return nil, nil, err
 	}
-	cert, err := x509.CreateCertificate(rand.Reader, &template, &template, &priKey.PublicKey, priKey)
+	cert, err := x509.CreateCertificate(rand.Reader, template, i.RootCa, priKey.Public(), i.RootKey)
 	if err != nil {
 		return nil, nil, err
 	}
-
-	// 将私钥写入.key文件
-	keyFd, _ := os.OpenFile("./cert.key", os.O_WRONLY|os.O_CREATE, os.ModePerm.Perm())
-	defer func() {
-		err = keyFd.Close()
-	}()
-	keyBlock := &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(priKey),
-	}
-	_ = pem.Encode(keyFd, keyBlock)
 	certBlock := &pem.Block{
 		Type:  "CERTIFICATE",
 		Bytes: cert,
 	}
-	// 将证书写入.crt文件
-	certFd, _ := os.OpenFile("./cert.crt", os.O_WRONLY|os.O_CREATE, os.ModePerm.Perm())
-	defer func() {
-		_ = certFd.Close()
-	}()
-	_ = pem.Encode(certFd, certBlock)
-	return certBlock, keyBlock, err
+	priKeyBlock, err := MarshalPrivateKey(priKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(certBlock), pem.EncodeToMemory(priKeyBlock), err
+}
+
+// 生成子证书的密钥,开启ReuseLeafKey时只生成一次
+func (i *Certificate) GenerateLeafKey() (crypto.Signer, error) {
+	if !i.ReuseLeafKey {
+		return i.generateLeafKey()
+	}
+	i.leafLock.Lock()
+	defer i.leafLock.Unlock()
+	if i.leafKey != nil {
+		return i.leafKey, nil
+	}
+	key, err := i.generateLeafKey()
+	if err != nil {
+		return nil, err
+	}
+	i.leafKey = key
+	return key, nil
+}
+
+func (i *Certificate) generateLeafKey() (crypto.Signer, error) {
+	if i.LeafKey == LeafKeyEcdsa {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, errors.New("密钥对生成失败")
+		}
+		return key, nil
+	}
+	return i.GenerateKeyPair()
+}
+
+// 解析pem格式的私钥
+func ParsePrivateKey(block *pem.Block) (crypto.Signer, error) {
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("不支持的私钥类型")
+	}
+	return signer, nil
+}
+
+// 将私钥编码为pem格式
+func MarshalPrivateKey(key crypto.Signer) (*pem.Block, error) {
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}, nil
+	case *ecdsa.PrivateKey:
+		buff, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return &pem.Block{Type: "EC PRIVATE KEY", Bytes: buff}, nil
+	}
+	buff, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &pem.Block{Type: "PRIVATE KEY", Bytes: buff}, nil
+}
+
+// 生成新的根证书
+func (i *Certificate) GenerateRootPemFile(host string) (*pem.Block, *pem.Block, error) {
+	options := DefaultRootOptions()
+	options.CommonName = host
+	err := i.GenerateRoot(options)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = i.Load()
+	if err != nil {
+		return nil, nil, err
+	}
+	keyBlock, err := MarshalPrivateKey(i.RootKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &pem.Block{Type: "CERTIFICATE", Bytes: i.RootCaStr}, keyBlock, nil
 }
 
 // 生成一对具有指定字位数的RSA密钥
@@ -0,0 +1,122 @@
+package Core
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// 根证书导出格式
+const (
+	ExportPem          = "pem"
+	ExportDer          = "der"
+	ExportP12          = "p12"
+	ExportMobileConfig = "mobileconfig"
+)
+
+// 各导出格式对应的文件后缀和Content-Type
+var ExportFormats = map[string][2]string{
+	ExportPem:          {".pem", "application/x-x509-ca-cert"},
+	ExportDer:          {".crt", "application/x-x509-ca-cert"},
+	ExportP12:          {".p12", "application/x-pkcs12"},
+	ExportMobileConfig: {".mobileconfig", "application/x-apple-aspen-config"},
+}
+
+// 按指定格式导出根证书,只包含证书不包含私钥,password只用于p12格式
+func (i *Certificate) Export(format string, password string) ([]byte, error) {
+	if i.RootCa == nil {
+		return nil, errors.New("根证书未初始化")
+	}
+	switch strings.ToLower(format) {
+	case ExportPem:
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: i.RootCaStr}), nil
+	case ExportDer:
+		return i.RootCaStr, nil
+	case ExportP12:
+		data, err := pkcs12.LegacyRC2.EncodeTrustStore([]*x509.Certificate{i.RootCa}, password)
+		if err != nil {
+			return nil, fmt.Errorf("导出p12证书失败：%w", err)
+		}
+		return data, nil
+	case ExportMobileConfig:
+		return i.mobileConfig(), nil
+	}
+	return nil, errors.New("不支持的导出格式：" + format)
+}
+
+// 根证书的sha256指纹,与证书页面和系统证书查看器显示的格式一致
+func (i *Certificate) Fingerprint() string {
+	sum := sha256.Sum256(i.RootCaStr)
+	return formatFingerprint(sum[:])
+}
+
+// 指纹格式化为冒号分隔的十六进制
+func formatFingerprint(sum []byte) string {
+	parts := make([]string, len(sum))
+	for index, b := range sum {
+		parts[index] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// 生成苹果设备使用的描述文件,安装后需要在设置中手动信任根证书
+func (i *Certificate) mobileConfig() []byte {
+	name := i.RootCa.Subject.CommonName
+	identifier := "com.shermie.proxy." + strings.ReplaceAll(i.Fingerprint(), ":", "")[:16]
+	return []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>PayloadContent</key>
+	<array>
+		<dict>
+			<key>PayloadCertificateFileName</key>
+			<string>` + xmlEscape(name) + `.cer</string>
+			<key>PayloadContent</key>
+			<data>` + base64.StdEncoding.EncodeToString(i.RootCaStr) + `</data>
+			<key>PayloadDisplayName</key>
+			<string>` + xmlEscape(name) + `</string>
+			<key>PayloadIdentifier</key>
+			<string>` + identifier + `.cert</string>
+			<key>PayloadType</key>
+			<string>com.apple.security.root</string>
+			<key>PayloadUUID</key>
+			<string>` + newUuid() + `</string>
+			<key>PayloadVersion</key>
+			<integer>1</integer>
+		</dict>
+	</array>
+	<key>PayloadDisplayName</key>
+	<string>` + xmlEscape(name) + `</string>
+	<key>PayloadIdentifier</key>
+	<string>` + identifier + `</string>
+	<key>PayloadType</key>
+	<string>Configuration</string>
+	<key>PayloadUUID</key>
+	<string>` + newUuid() + `</string>
+	<key>PayloadVersion</key>
+	<integer>1</integer>
+</dict>
+</plist>
+`)
+}
+
+func xmlEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;", "'", "&apos;").Replace(s)
+}
+
+// 生成随机的uuid v4
+func newUuid() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return strings.ToUpper(fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]))
+}
@@ -0,0 +1,161 @@
+package Core
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// 解码后交给事件处理,返回客户端前按原始编码重新压缩
+	EncodingKeep = iota
+	// 解码后交给事件处理,移除Content-Encoding以明文返回客户端
+	EncodingIdentity
+)
+
+// 内容编码的编解码器
+type Codec interface {
+	NewReader(reader io.Reader) (io.ReadCloser, error)
+	NewWriter(writer io.Writer) (io.WriteCloser, error)
+}
+
+// 支持的内容编码
+var Codecs = map[string]Codec{
+	"gzip":    gzipCodec{},
+	"x-gzip":  gzipCodec{},
+	"deflate": deflateCodec{},
+	"br":      brotliCodec{},
+	"zstd":    zstdCodec{},
+}
+
+type gzipCodec struct{}
+
+func (i gzipCodec) NewReader(reader io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(reader)
+}
+
+func (i gzipCodec) NewWriter(writer io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(writer), nil
+}
+
+type deflateCodec struct{}
+
+// deflate按规范应为zlib格式,但部分服务器直接返回裸deflate数据,需要根据头部判断
+func (i deflateCodec) NewReader(reader io.Reader) (io.ReadCloser, error) {
+	buffer := bufio.NewReader(reader)
+	header, err := buffer.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+	if header[0]&0x0F == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(buffer)
+	}
+	return flate.NewReader(buffer), nil
+}
+
+func (i deflateCodec) NewWriter(writer io.Writer) (io.WriteCloser, error) {
+	return zlib.NewWriter(writer), nil
+}
+
+type brotliCodec struct{}
+
+func (i brotliCodec) NewReader(reader io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(brotli.NewReader(reader)), nil
+}
+
+func (i brotliCodec) NewWriter(writer io.Writer) (io.WriteCloser, error) {
+	return brotli.NewWriter(writer), nil
+}
+
+type zstdCodec struct{}
+
+func (i zstdCodec) NewReader(reader io.Reader) (io.ReadCloser, error) {
+	decoder, err := zstd.NewReader(reader)
+	if err != nil {
+		return nil, err
+	}
+	return decoder.IOReadCloser(), nil
+}
+
+func (i zstdCodec) NewWriter(writer io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(writer)
+}
+
+// 解析Content-Encoding,按编码的先后顺序返回,identity会被忽略
+func ContentEncodings(header http.Header) []string {
+	var encodings []string
+	for _, value := range header.Values("Content-Encoding") {
+		for _, encoding := range strings.Split(value, ",") {
+			encoding = strings.ToLower(strings.TrimSpace(encoding))
+			if encoding != "" && encoding != "identity" {
+				encodings = append(encodings, encoding)
+			}
+		}
+	}
+	return encodings
+}
+
+// 按编码顺序的逆序解码
+func DecodeBody(body []byte, encodings []string) ([]byte, error) {
+	for n := len(encodings) - 1; n >= 0; n-- {
+		codec, ok := Codecs[encodings[n]]
+		if !ok {
+			return nil, fmt.Errorf("不支持的内容编码：%s", encodings[n])
+		}
+		reader, err := codec.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("解码%s数据失败：%w", encodings[n], err)
+		}
+		body, err = io.ReadAll(reader)
+		_ = reader.Close()
+		if err != nil {
+			return nil, fmt.Errorf("解码%s数据失败：%w", encodings[n], err)
+		}
+	}
+	return body, nil
+}
+
+// 按编码顺序依次编码
+func EncodeBody(body []byte, encodings []string) ([]byte, error) {
+	for _, encoding := range encodings {
+		codec, ok := Codecs[encoding]
+		if !ok {
+			return nil, fmt.Errorf("不支持的内容编码：%s", encoding)
+		}
+		buffer := &bytes.Buffer{}
+		writer, err := codec.NewWriter(buffer)
+		if err != nil {
+			return nil, fmt.Errorf("编码%s数据失败：%w", encoding, err)
+		}
+		_, err = writer.Write(body)
+		if err == nil {
+			err = writer.Close()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("编码%s数据失败：%w", encoding, err)
+		}
+		body = buffer.Bytes()
+	}
+	return body, nil
+}
+
+// 过滤Accept-Encoding,只保留可以解码的编码
+func FilterAcceptEncoding(value string) string {
+	var accepted []string
+	for _, item := range strings.Split(value, ",") {
+		encoding := strings.ToLower(strings.TrimSpace(strings.Split(item, ";")[0]))
+		if _, ok := Codecs[encoding]; ok || encoding == "identity" {
+			accepted = append(accepted, strings.TrimSpace(item))
+		}
+	}
+	return strings.Join(accepted, ", ")
+}
@@ -11,3 +11,17 @@ type ConnPeer struct {
 	reader *bufio.Reader
 	server *ProxyServer
 }
+
+// 从缓冲区读取数据的连接,用于在探测协议后继续读取已缓冲的数据
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (i *bufferedConn) Read(buff []byte) (int, error) {
+	return i.reader.Read(buff)
+}
+
+func (i *bufferedConn) NetConn() net.Conn {
+	return i.Conn
+}
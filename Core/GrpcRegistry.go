@@ -0,0 +1,317 @@
+package Core
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// grpc服务描述,用于将消息解码为json
+type GrpcRegistry struct {
+	lock   *sync.RWMutex
+	protos map[string]*descriptorpb.FileDescriptorProto
+	files  *protoregistry.Files
+}
+
+func NewGrpcRegistry() *GrpcRegistry {
+	return &GrpcRegistry{
+		lock:   &sync.RWMutex{},
+		protos: map[string]*descriptorpb.FileDescriptorProto{},
+		files:  &protoregistry.Files{},
+	}
+}
+
+// 加载protoc --include_imports --descriptor_set_out生成的描述文件
+func (i *GrpcRegistry) LoadDescriptorSet(file string) error {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("读取grpc描述文件失败：%w", err)
+	}
+	set := &descriptorpb.FileDescriptorSet{}
+	err = proto.Unmarshal(content, set)
+	if err != nil {
+		return fmt.Errorf("解析grpc描述文件失败：%w", err)
+	}
+	return i.register(set.File)
+}
+
+// 通过服务反射获取描述文件,address为本地明文(h2c)grpc服务地址
+func (i *GrpcRegistry) LoadReflection(address string) error {
+	client := &grpcReflectionClient{address: address}
+	services, err := client.listServices()
+	if err != nil {
+		return err
+	}
+	var files []*descriptorpb.FileDescriptorProto
+	for _, service := range services {
+		items, err := client.fileContainingSymbol(service)
+		if err != nil {
+			return err
+		}
+		// 同一文件中的多个服务和公共依赖会重复返回,重复的文件无法注册
+		for _, item := range items {
+			if !containsFile(files, item.GetName()) {
+				files = append(files, item)
+			}
+		}
+	}
+	return i.register(files)
+}
+
+func (i *GrpcRegistry) register(files []*descriptorpb.FileDescriptorProto) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	set := &descriptorpb.FileDescriptorSet{}
+	for name, file := range i.protos {
+		if !containsFile(files, name) {
+			set.File = append(set.File, file)
+		}
+	}
+	set.File = append(set.File, files...)
+	registry, err := protodesc.NewFiles(set)
+	if err != nil {
+		return fmt.Errorf("注册grpc描述文件失败：%w", err)
+	}
+	for _, file := range files {
+		i.protos[file.GetName()] = file
+	}
+	i.files = registry
+	return nil
+}
+
+func containsFile(files []*descriptorpb.FileDescriptorProto, name string) bool {
+	for _, file := range files {
+		if file.GetName() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// 查找方法对应的请求或响应消息类型
+func (i *GrpcRegistry) messageType(service string, method string, response bool) (protoreflect.MessageDescriptor, error) {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	descriptor, err := i.files.FindDescriptorByName(protoreflect.FullName(service))
+	if err != nil {
+		return nil, fmt.Errorf("未找到grpc服务%s：%w", service, err)
+	}
+	serviceDescriptor, ok := descriptor.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s不是grpc服务", service)
+	}
+	methodDescriptor := serviceDescriptor.Methods().ByName(protoreflect.Name(method))
+	if methodDescriptor == nil {
+		return nil, fmt.Errorf("未找到grpc方法%s/%s", service, method)
+	}
+	if response {
+		return methodDescriptor.Output(), nil
+	}
+	return methodDescriptor.Input(), nil
+}
+
+// protobuf数据转json
+func (i *GrpcRegistry) ToJson(service string, method string, response bool, data []byte) ([]byte, error) {
+	messageType, err := i.messageType(service, method, response)
+	if err != nil {
+		return nil, err
+	}
+	message := dynamicpb.NewMessage(messageType)
+	err = proto.Unmarshal(data, message)
+	if err != nil {
+		return nil, fmt.Errorf("解析grpc消息失败：%w", err)
+	}
+	return protojson.Marshal(message)
+}
+
+// json转protobuf数据
+func (i *GrpcRegistry) FromJson(service string, method string, response bool, data []byte) ([]byte, error) {
+	messageType, err := i.messageType(service, method, response)
+	if err != nil {
+		return nil, err
+	}
+	message := dynamicpb.NewMessage(messageType)
+	err = protojson.Unmarshal(data, message)
+	if err != nil {
+		return nil, fmt.Errorf("解析grpc json失败：%w", err)
+	}
+	return proto.Marshal(message)
+}
+
+// grpc服务反射客户端,反射协议的消息结构简单,直接按protobuf编码规则读写
+type grpcReflectionClient struct {
+	address string
+}
+
+var grpcReflectionPaths = []string{
+	"/grpc.reflection.v1.ServerReflection/ServerReflectionInfo",
+	"/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo",
+}
+
+const (
+	reflectionFileContainingSymbol = 4
+	reflectionListServices         = 7
+	reflectionFileDescriptor       = 4
+	reflectionServiceList          = 6
+	reflectionError                = 7
+)
+
+// 获取所有服务名
+func (i *grpcReflectionClient) listServices() ([]string, error) {
+	responses, err := i.call(reflectionListServices, "*")
+	if err != nil {
+		return nil, err
+	}
+	var services []string
+	for _, response := range responses {
+		for _, list := range protoFields(response, reflectionServiceList) {
+			for _, service := range protoFields(list, 1) {
+				for _, name := range protoFields(service, 1) {
+					if string(name) != "grpc.reflection.v1.ServerReflection" && string(name) != "grpc.reflection.v1alpha.ServerReflection" {
+						services = append(services, string(name))
+					}
+				}
+			}
+		}
+	}
+	return services, nil
+}
+
+// 获取包含指定符号的描述文件及其依赖
+func (i *grpcReflectionClient) fileContainingSymbol(symbol string) ([]*descriptorpb.FileDescriptorProto, error) {
+	responses, err := i.call(reflectionFileContainingSymbol, symbol)
+	if err != nil {
+		return nil, err
+	}
+	var files []*descriptorpb.FileDescriptorProto
+	for _, response := range responses {
+		for _, descriptor := range protoFields(response, reflectionFileDescriptor) {
+			for _, content := range protoFields(descriptor, 1) {
+				file := &descriptorpb.FileDescriptorProto{}
+				err = proto.Unmarshal(content, file)
+				if err != nil {
+					return nil, fmt.Errorf("解析反射描述文件失败：%w", err)
+				}
+				files = append(files, file)
+			}
+		}
+	}
+	return files, nil
+}
+
+// 发送一条反射请求,依次尝试v1和v1alpha版本
+func (i *grpcReflectionClient) call(field protowire.Number, value string) ([][]byte, error) {
+	request := protowire.AppendTag(nil, field, protowire.BytesType)
+	request = protowire.AppendString(request, value)
+	var lastErr error
+	for _, path := range grpcReflectionPaths {
+		responses, err := i.post(path, request)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, response := range responses {
+			for _, item := range protoFields(response, reflectionError) {
+				var message string
+				if values := protoFields(item, 2); len(values) > 0 {
+					message = string(values[0])
+				}
+				return nil, fmt.Errorf("grpc反射请求失败：%s", message)
+			}
+		}
+		return responses, nil
+	}
+	return nil, lastErr
+}
+
+func (i *grpcReflectionClient) post(path string, message []byte) ([][]byte, error) {
+	transport := &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, config *tls.Config) (net.Conn, error) {
+			return (&net.Dialer{Timeout: time.Second * 10}).DialContext(ctx, network, addr)
+		},
+	}
+	defer transport.CloseIdleConnections()
+	body := &bytes.Buffer{}
+	err := writeGrpcMessage(body, &GrpcMessage{Data: message}, "")
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequest(http.MethodPost, "http://"+i.address+path, body)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/grpc")
+	request.Header.Set("Te", "trailers")
+	response, err := transport.RoundTrip(request)
+	if err != nil {
+		return nil, fmt.Errorf("连接grpc反射服务失败：%w", err)
+	}
+	defer func() {
+		_ = response.Body.Close()
+	}()
+	var messages [][]byte
+	for {
+		message, err := readGrpcMessage(response.Body, response.Header.Get("Grpc-Encoding"))
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message.Data)
+	}
+	call := &GrpcCall{Response: response}
+	if code, message := call.Status(); code != 0 {
+		return nil, fmt.Errorf("grpc反射请求失败：%d %s", code, message)
+	}
+	if len(messages) == 0 {
+		return nil, errors.New("grpc反射服务无响应")
+	}
+	return messages, nil
+}
+
+// 读取protobuf消息中指定编号的字节类型字段
+func protoFields(message []byte, field protowire.Number) [][]byte {
+	var values [][]byte
+	for len(message) > 0 {
+		number, fieldType, n := protowire.ConsumeTag(message)
+		if n < 0 {
+			return values
+		}
+		message = message[n:]
+		if fieldType == protowire.BytesType && number == field {
+			value, n := protowire.ConsumeBytes(message)
+			if n < 0 {
+				return values
+			}
+			values = append(values, value)
+			message = message[n:]
+			continue
+		}
+		n = protowire.ConsumeFieldValue(number, fieldType, message)
+		if n < 0 {
+			return values
+		}
+		message = message[n:]
+	}
+	return values
+}
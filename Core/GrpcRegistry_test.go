@@ -0,0 +1,97 @@
+package Core
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// 两个服务定义在同一个文件中,并且依赖公共的empty.proto
+func reflectionTestFiles() []*descriptorpb.FileDescriptorProto {
+	file := &descriptorpb.FileDescriptorProto{
+		Name:       proto.String("test.proto"),
+		Package:    proto.String("test"),
+		Syntax:     proto.String("proto3"),
+		Dependency: []string{"google/protobuf/empty.proto"},
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Ping"),
+			Field: []*descriptorpb.FieldDescriptorProto{{
+				Name:     proto.String("text"),
+				JsonName: proto.String("text"),
+				Number:   proto.Int32(1),
+				Type:     descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(),
+				Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			}},
+		}},
+		Service: []*descriptorpb.ServiceDescriptorProto{
+			{
+				Name:   proto.String("Alpha"),
+				Method: []*descriptorpb.MethodDescriptorProto{{Name: proto.String("Ping"), InputType: proto.String(".test.Ping"), OutputType: proto.String(".google.protobuf.Empty")}},
+			},
+			{
+				Name:   proto.String("Beta"),
+				Method: []*descriptorpb.MethodDescriptorProto{{Name: proto.String("Echo"), InputType: proto.String(".test.Ping"), OutputType: proto.String(".test.Ping")}},
+			},
+		},
+	}
+	return []*descriptorpb.FileDescriptorProto{file, protodesc.ToFileDescriptorProto(emptypb.File_google_protobuf_empty_proto)}
+}
+
+// 模拟grpc反射服务,每个服务都返回完整的文件和依赖
+func reflectionTestHandler(t *testing.T) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		message, err := readGrpcMessage(request.Body, "")
+		if err != nil {
+			t.Errorf("读取反射请求失败：%v", err)
+			return
+		}
+		var response []byte
+		if len(protoFields(message.Data, reflectionListServices)) > 0 {
+			var list []byte
+			for _, name := range []string{"test.Alpha", "test.Beta", "grpc.reflection.v1.ServerReflection"} {
+				service := protowire.AppendString(protowire.AppendTag(nil, 1, protowire.BytesType), name)
+				list = protowire.AppendBytes(protowire.AppendTag(list, 1, protowire.BytesType), service)
+			}
+			response = protowire.AppendBytes(protowire.AppendTag(nil, reflectionServiceList, protowire.BytesType), list)
+		} else {
+			var descriptor []byte
+			for _, file := range reflectionTestFiles() {
+				content, _ := proto.Marshal(file)
+				descriptor = protowire.AppendBytes(protowire.AppendTag(descriptor, 1, protowire.BytesType), content)
+			}
+			response = protowire.AppendBytes(protowire.AppendTag(nil, reflectionFileDescriptor, protowire.BytesType), descriptor)
+		}
+		writer.Header().Set("Content-Type", "application/grpc")
+		writer.Header().Set("Trailer", "Grpc-Status")
+		_ = writeGrpcMessage(writer, &GrpcMessage{Data: response}, "")
+		writer.Header().Set("Grpc-Status", "0")
+	})
+}
+
+func TestLoadReflectionSharedFile(t *testing.T) {
+	server := httptest.NewServer(h2c.NewHandler(reflectionTestHandler(t), &http2.Server{}))
+	defer server.Close()
+	registry := NewGrpcRegistry()
+	err := registry.LoadReflection(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("加载反射描述文件失败：%v", err)
+	}
+	data := protowire.AppendString(protowire.AppendTag(nil, 1, protowire.BytesType), "hi")
+	for _, item := range []struct{ service, method string }{{"test.Alpha", "Ping"}, {"test.Beta", "Echo"}} {
+		content, err := registry.ToJson(item.service, item.method, false, data)
+		if err != nil {
+			t.Fatalf("%s/%s解码失败：%v", item.service, item.method, err)
+		}
+		if string(content) != `{"text":"hi"}` && string(content) != `{"text": "hi"}` {
+			t.Fatalf("%s/%s解码结果错误：%s", item.service, item.method, content)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package Core
+
+import (
+	"net"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/k8scat/shermie-proxy/Log"
+)
+
+// 决定哪些域名需要解密,规则支持:
+//   - 通配符,如 *.example.com,使用path.Match匹配
+//   - 正则,以re:开头,如 re:^api\d+\.example\.com$
+//   - ip或CIDR,如 10.0.0.0/8,只匹配直接使用ip访问的请求
+type MitmPolicy struct {
+	// 为空时解密所有域名
+	Include []string
+	// 优先级高于Include
+	Exclude []string
+	// 客户端拒绝证书后该域名直接转发的时间,为0时不记录
+	PassthroughTTL time.Duration
+	lock           *sync.Mutex
+	learned        map[string]time.Time
+	rules          map[string]func(host string) bool
+}
+
+func NewMitmPolicy() *MitmPolicy {
+	return &MitmPolicy{
+		PassthroughTTL: time.Minute * 30,
+		lock:           &sync.Mutex{},
+		learned:        map[string]time.Time{},
+		rules:          map[string]func(host string) bool{},
+	}
+}
+
+// 是否需要解密,host不包含端口
+func (i *MitmPolicy) ShouldIntercept(host string) bool {
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	if i.isLearned(host) {
+		return false
+	}
+	if i.match(i.Exclude, host) {
+		return false
+	}
+	return len(i.Include) == 0 || i.match(i.Include, host)
+}
+
+// 记录客户端握手失败的域名,在PassthroughTTL内直接转发
+func (i *MitmPolicy) Learn(host string) {
+	if i.PassthroughTTL <= 0 {
+		return
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	i.lock.Lock()
+	i.learned[host] = time.Now().Add(i.PassthroughTTL)
+	i.lock.Unlock()
+	Log.Log.Println("客户端拒绝证书，该域名暂时不再解密：" + host)
+}
+
+// 移除记录的域名
+func (i *MitmPolicy) Forget(host string) {
+	i.lock.Lock()
+	delete(i.learned, strings.ToLower(strings.Trim(host, "[]")))
+	i.lock.Unlock()
+}
+
+// 当前直接转发的域名及过期时间
+func (i *MitmPolicy) Learned() map[string]time.Time {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	learned := map[string]time.Time{}
+	for host, expire := range i.learned {
+		if time.Now().Before(expire) {
+			learned[host] = expire
+		}
+	}
+	return learned
+}
+
+func (i *MitmPolicy) isLearned(host string) bool {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	expire, ok := i.learned[host]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expire) {
+		delete(i.learned, host)
+		return false
+	}
+	return true
+}
+
+func (i *MitmPolicy) match(rules []string, host string) bool {
+	for _, rule := range rules {
+		if i.compile(rule)(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// 编译后的规则会被缓存
+func (i *MitmPolicy) compile(rule string) func(host string) bool {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if fn, ok := i.rules[rule]; ok {
+		return fn
+	}
+	fn := func(host string) bool {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(rule, "re:"):
+		expr, err := regexp.Compile(strings.TrimPrefix(rule, "re:"))
+		if err != nil {
+			Log.Log.Println("解析解密规则错误：" + err.Error())
+			break
+		}
+		fn = expr.MatchString
+	case strings.Contains(rule, "/"):
+		_, network, err := net.ParseCIDR(rule)
+		if err != nil {
+			Log.Log.Println("解析解密规则错误：" + err.Error())
+			break
+		}
+		fn = func(host string) bool {
+			ip := net.ParseIP(host)
+			return ip != nil && network.Contains(ip)
+		}
+	case net.ParseIP(rule) != nil:
+		ruleIp := net.ParseIP(rule)
+		fn = func(host string) bool {
+			return ruleIp.Equal(net.ParseIP(host))
+		}
+	default:
+		pattern := strings.ToLower(rule)
+		fn = func(host string) bool {
+			matched, _ := path.Match(pattern, host)
+			return matched
+		}
+	}
+	i.rules[rule] = fn
+	return fn
+}
@@ -0,0 +1,349 @@
+package Core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+// PAC标准函数中可以用js实现的部分
+const pacUtils = `
+function dnsDomainIs(host, domain) {
+	return host.length >= domain.length && host.substring(host.length - domain.length) === domain;
+}
+function dnsDomainLevels(host) {
+	return host.split('.').length - 1;
+}
+function isPlainHostName(host) {
+	return host.indexOf('.') < 0;
+}
+function localHostOrDomainIs(host, hostdom) {
+	return host === hostdom || hostdom.lastIndexOf(host + '.', 0) === 0;
+}
+function isResolvable(host) {
+	return dnsResolve(host) !== null;
+}
+function convert_addr(ipchars) {
+	var bytes = ipchars.split('.');
+	return ((bytes[0] & 0xff) << 24) | ((bytes[1] & 0xff) << 16) | ((bytes[2] & 0xff) << 8) | (bytes[3] & 0xff);
+}
+function isInNet(ipaddr, pattern, maskstr) {
+	if (!/^\d+\.\d+\.\d+\.\d+$/.test(ipaddr)) {
+		ipaddr = dnsResolve(ipaddr);
+		if (ipaddr === null) {
+			return false;
+		}
+	}
+	return (convert_addr(ipaddr) & convert_addr(maskstr)) === (convert_addr(pattern) & convert_addr(maskstr));
+}
+function shExpMatch(url, pattern) {
+	pattern = pattern.replace(/\./g, '\\.').replace(/\*/g, '.*').replace(/\?/g, '.');
+	return new RegExp('^' + pattern + '$').test(url);
+}
+function weekdayRange(wd1, wd2, gmt) {
+	var days = ['SUN', 'MON', 'TUE', 'WED', 'THU', 'FRI', 'SAT'];
+	if (wd2 === 'GMT') {
+		gmt = wd2;
+		wd2 = undefined;
+	}
+	var now = new Date();
+	var today = gmt === 'GMT' ? now.getUTCDay() : now.getDay();
+	var start = days.indexOf(wd1);
+	var end = wd2 === undefined ? start : days.indexOf(wd2);
+	return start <= end ? today >= start && today <= end : today >= start || today <= end;
+}
+function timeRange() {
+	var args = Array.prototype.slice.call(arguments);
+	var gmt = args[args.length - 1] === 'GMT';
+	if (gmt) {
+		args.pop();
+	}
+	var now = new Date();
+	var current = gmt ? now.getUTCHours() * 3600 + now.getUTCMinutes() * 60 + now.getUTCSeconds() : now.getHours() * 3600 + now.getMinutes() * 60 + now.getSeconds();
+	var start, end;
+	if (args.length === 1) {
+		start = args[0] * 3600;
+		end = start + 3599;
+	} else if (args.length === 2) {
+		start = args[0] * 3600;
+		end = args[1] * 3600 - 1;
+	} else if (args.length === 4) {
+		start = args[0] * 3600 + args[1] * 60;
+		end = args[2] * 3600 + args[3] * 60 - 1;
+	} else if (args.length === 6) {
+		start = args[0] * 3600 + args[1] * 60 + args[2];
+		end = args[3] * 3600 + args[4] * 60 + args[5];
+	} else {
+		return false;
+	}
+	return start <= end ? current >= start && current <= end : current >= start || current <= end;
+}
+// 日期范围很少使用,不做判断
+function dateRange() {
+	return true;
+}
+`
+
+// PAC脚本,使用内置的js解释器执行FindProxyForURL
+type PacScript struct {
+	// 脚本中dnsResolve的超时时间
+	DnsTimeout time.Duration
+	// 同一目标地址的结果缓存时间,为0时每次都执行脚本
+	CacheTtl time.Duration
+	lock     *sync.Mutex
+	program  *goja.Program
+	// js解释器不能并发使用,每次执行从池中取出一个
+	runtimes *sync.Pool
+	upstream map[string]*UpstreamProxy
+	groups   map[string]*UpstreamGroup
+	cache    map[string]pacResult
+	resolver Resolver
+}
+
+// 最多缓存的目标地址数量
+const pacCacheEntries = 10000
+
+type pacResult struct {
+	route   *Route
+	expires time.Time
+}
+
+type pacRuntime struct {
+	runtime *goja.Runtime
+	find    goja.Callable
+}
+
+var pacUtilsProgram = goja.MustCompile("pac_utils.js", pacUtils, false)
+
+// 加载PAC文件,resolver用于脚本中的dnsResolve,为空时使用默认的域名解析
+func LoadPacScript(file string, resolver Resolver) (*PacScript, error) {
+	source, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("读取PAC文件错误：%w", err)
+	}
+	return NewPacScript(string(source), resolver)
+}
+
+func NewPacScript(source string, resolver Resolver) (*PacScript, error) {
+	program, err := goja.Compile("pac.js", source, false)
+	if err != nil {
+		return nil, fmt.Errorf("解析PAC脚本错误：%w", err)
+	}
+	if resolver == nil {
+		resolver = NewDnsResolver()
+	}
+	script := &PacScript{
+		DnsTimeout: time.Second * 2,
+		CacheTtl:   time.Minute,
+		lock:       &sync.Mutex{},
+		program:    program,
+		upstream:   map[string]*UpstreamProxy{},
+		groups:     map[string]*UpstreamGroup{},
+		cache:      map[string]pacResult{},
+		resolver:   resolver,
+	}
+	// 先创建一个解释器检查脚本,之后按需创建
+	runtime, err := script.newRuntime()
+	if err != nil {
+		return nil, err
+	}
+	script.runtimes = &sync.Pool{
+		New: func() interface{} {
+			runtime, err := script.newRuntime()
+			if err != nil {
+				return err
+			}
+			return runtime
+		},
+	}
+	script.runtimes.Put(runtime)
+	return script, nil
+}
+
+func (i *PacScript) newRuntime() (*pacRuntime, error) {
+	runtime := goja.New()
+	// 使用代理服务的域名解析,每个解释器只在一个协程中执行,不需要加锁
+	_ = runtime.Set("dnsResolve", func(host string) interface{} {
+		ctx, cancel := context.WithTimeout(context.Background(), i.DnsTimeout)
+		defer cancel()
+		ips, err := i.resolver.LookupIP(ctx, host)
+		if err != nil {
+			return nil
+		}
+		for _, ip := range ips {
+			if ip4 := ip.To4(); ip4 != nil {
+				return ip4.String()
+			}
+		}
+		return nil
+	})
+	_ = runtime.Set("myIpAddress", func() string {
+		addrs, err := net.InterfaceAddrs()
+		if err == nil {
+			for _, addr := range addrs {
+				if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+					return ipNet.IP.String()
+				}
+			}
+		}
+		return "127.0.0.1"
+	})
+	_, err := runtime.RunProgram(pacUtilsProgram)
+	if err != nil {
+		return nil, err
+	}
+	_, err = runtime.RunProgram(i.program)
+	if err != nil {
+		return nil, fmt.Errorf("解析PAC脚本错误：%w", err)
+	}
+	find, ok := goja.AssertFunction(runtime.Get("FindProxyForURL"))
+	if !ok {
+		return nil, errors.New("PAC脚本中没有FindProxyForURL函数")
+	}
+	return &pacRuntime{runtime: runtime, find: find}, nil
+}
+
+// 执行FindProxyForURL,返回原始结果,如 "PROXY 10.0.0.1:8080; DIRECT"
+func (i *PacScript) FindProxyForURL(url string, host string) (string, error) {
+	item := i.runtimes.Get()
+	runtime, ok := item.(*pacRuntime)
+	if !ok {
+		return "", item.(error)
+	}
+	defer i.runtimes.Put(runtime)
+	value, err := runtime.find(goja.Undefined(), runtime.runtime.ToValue(url), runtime.runtime.ToValue(host))
+	if err != nil {
+		return "", err
+	}
+	return value.String(), nil
+}
+
+// 按目标地址执行脚本并转换为路由,结果按目标地址缓存CacheTtl
+func (i *PacScript) Route(host string, port string) (*Route, error) {
+	key := net.JoinHostPort(host, port)
+	if i.CacheTtl > 0 {
+		i.lock.Lock()
+		item, ok := i.cache[key]
+		i.lock.Unlock()
+		if ok && time.Now().Before(item.expires) {
+			return item.route, nil
+		}
+	}
+	url := "http://" + key + "/"
+	if port == "443" {
+		url = "https://" + host + "/"
+	}
+	result, err := i.FindProxyForURL(url, host)
+	if err != nil {
+		return nil, err
+	}
+	route, err := i.parseResult(result)
+	if err != nil {
+		return nil, err
+	}
+	if i.CacheTtl > 0 {
+		now := time.Now()
+		i.lock.Lock()
+		// 超过上限时先清理过期的结果,仍然超过时全部清空
+		if len(i.cache) >= pacCacheEntries {
+			for cacheKey, item := range i.cache {
+				if !now.Before(item.expires) {
+					delete(i.cache, cacheKey)
+				}
+			}
+			if len(i.cache) >= pacCacheEntries {
+				i.cache = map[string]pacResult{}
+			}
+		}
+		i.cache[key] = pacResult{route: route, expires: now.Add(i.CacheTtl)}
+		i.lock.Unlock()
+	}
+	return route, nil
+}
+
+// 将脚本结果转换为路由,多个代理按顺序组成代理组,DIRECT作为所有代理都不可用时的备选
+func (i *PacScript) parseResult(result string) (*Route, error) {
+	var members []*UpstreamProxy
+	var names []string
+	direct := false
+	for _, item := range strings.Split(result, ";") {
+		fields := strings.Fields(item)
+		if len(fields) == 0 {
+			continue
+		}
+		scheme := ""
+		switch strings.ToUpper(fields[0]) {
+		case "DIRECT":
+			direct = true
+		case "PROXY", "HTTP":
+			scheme = UpstreamHttp
+		case "HTTPS":
+			scheme = UpstreamHttps
+		case "SOCKS", "SOCKS5":
+			scheme = UpstreamSocks5
+		default:
+			continue
+		}
+		// DIRECT之后的结果不会被使用
+		if direct {
+			break
+		}
+		if len(fields) < 2 {
+			continue
+		}
+		raw := scheme + "://" + fields[1]
+		upstream, err := i.getUpstream(raw)
+		if err != nil {
+			return nil, err
+		}
+		if !containsUpstream(members, upstream) {
+			members = append(members, upstream)
+			names = append(names, raw)
+		}
+	}
+	if len(members) == 0 {
+		if direct {
+			return &Route{Name: "pac", Action: RouteDirect}, nil
+		}
+		return nil, errors.New("PAC脚本返回的结果不支持：" + result)
+	}
+	if direct {
+		names = append(names, "DIRECT")
+	}
+	return &Route{Name: "pac", Action: RouteProxy, Group: i.getGroup(strings.Join(names, ";"), members, direct)}, nil
+}
+
+// 相同的结果复用同一个代理组,保证轮换和剔除状态一致
+func (i *PacScript) getGroup(key string, members []*UpstreamProxy, direct bool) *UpstreamGroup {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if group, ok := i.groups[key]; ok {
+		return group
+	}
+	group := NewUpstreamGroup(StrategyFailover, members...)
+	group.Direct = direct
+	i.groups[key] = group
+	return group
+}
+
+// 相同的代理地址复用同一个对象,保证连接池分组一致
+func (i *PacScript) getUpstream(raw string) (*UpstreamProxy, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if upstream, ok := i.upstream[raw]; ok {
+		return upstream, nil
+	}
+	upstream, err := ParseUpstreamProxy(raw)
+	if err != nil {
+		return nil, err
+	}
+	i.upstream[raw] = upstream
+	return upstream, nil
+}
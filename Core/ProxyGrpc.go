@@ -0,0 +1,245 @@
+package Core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/k8scat/shermie-proxy/Log"
+)
+
+// grpc单条消息的最大长度
+const GrpcMaxMessageSize = 64 << 20
+
+// grpc消息,Data为解压后的protobuf数据
+type GrpcMessage struct {
+	Compressed bool
+	Data       []byte
+	// 压缩算法不支持时Data保持原样
+	decoded bool
+}
+
+// 一次grpc调用
+type GrpcCall struct {
+	Service  string
+	Method   string
+	Request  *http.Request
+	Response *http.Response
+	registry *GrpcRegistry
+}
+
+type ResolveGrpc func(message *GrpcMessage) error
+
+// 是否是grpc报文
+func IsGrpc(header http.Header) bool {
+	return strings.HasPrefix(header.Get("Content-Type"), "application/grpc")
+}
+
+func NewGrpcCall(request *http.Request, registry *GrpcRegistry) *GrpcCall {
+	call := &GrpcCall{
+		Request:  request,
+		registry: registry,
+	}
+	// 请求路径格式为 /包名.服务名/方法名
+	path := strings.TrimPrefix(request.URL.Path, "/")
+	if separator := strings.LastIndex(path, "/"); separator != -1 {
+		call.Service = path[:separator]
+		call.Method = path[separator+1:]
+	}
+	return call
+}
+
+// 获取调用结果,只有响应体读取完成后trailer中才有数据,仅有header的响应直接从header中获取
+func (i *GrpcCall) Status() (int, string) {
+	if i.Response == nil {
+		return -1, ""
+	}
+	status := i.Response.Trailer.Get("Grpc-Status")
+	message := i.Response.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status = i.Response.Header.Get("Grpc-Status")
+		message = i.Response.Header.Get("Grpc-Message")
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return -1, message
+	}
+	return code, message
+}
+
+// 将请求消息解码为json,需要先加载服务的描述文件
+func (i *GrpcCall) DecodeRequest(message *GrpcMessage) ([]byte, error) {
+	return i.decode(message, false)
+}
+
+// 将响应消息解码为json
+func (i *GrpcCall) DecodeResponse(message *GrpcMessage) ([]byte, error) {
+	return i.decode(message, true)
+}
+
+// 将json编码为请求消息
+func (i *GrpcCall) EncodeRequest(data []byte) (*GrpcMessage, error) {
+	return i.encode(data, false)
+}
+
+// 将json编码为响应消息
+func (i *GrpcCall) EncodeResponse(data []byte) (*GrpcMessage, error) {
+	return i.encode(data, true)
+}
+
+func (i *GrpcCall) decode(message *GrpcMessage, response bool) ([]byte, error) {
+	if i.registry == nil {
+		return nil, errors.New("未加载grpc描述文件")
+	}
+	if message.Compressed && !message.decoded {
+		return nil, errors.New("不支持的grpc压缩算法")
+	}
+	return i.registry.ToJson(i.Service, i.Method, response, message.Data)
+}
+
+func (i *GrpcCall) encode(data []byte, response bool) (*GrpcMessage, error) {
+	if i.registry == nil {
+		return nil, errors.New("未加载grpc描述文件")
+	}
+	buff, err := i.registry.FromJson(i.Service, i.Method, response, data)
+	if err != nil {
+		return nil, err
+	}
+	return &GrpcMessage{Data: buff, decoded: true}, nil
+}
+
+// 读取一条grpc消息,格式为1字节压缩标识、4字节大端长度、消息内容
+func readGrpcMessage(reader io.Reader, encoding string) (*GrpcMessage, error) {
+	header := make([]byte, 5)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.New("grpc消息头不完整")
+		}
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > GrpcMaxMessageSize {
+		return nil, fmt.Errorf("grpc消息长度超出限制：%d", length)
+	}
+	message := &GrpcMessage{
+		Compressed: header[0]&0x01 == 1,
+		Data:       make([]byte, length),
+	}
+	_, err = io.ReadFull(reader, message.Data)
+	if err != nil {
+		return nil, fmt.Errorf("读取grpc消息失败：%w", err)
+	}
+	if !message.Compressed {
+		message.decoded = true
+		return message, nil
+	}
+	if _, ok := Codecs[encoding]; ok {
+		data, err := DecodeBody(message.Data, []string{encoding})
+		if err != nil {
+			return nil, err
+		}
+		message.Data = data
+		message.decoded = true
+	}
+	return message, nil
+}
+
+// 写入一条grpc消息,解压过的消息按原算法重新压缩
+func writeGrpcMessage(writer io.Writer, message *GrpcMessage, encoding string) error {
+	var err error
+	data := message.Data
+	if message.Compressed && message.decoded {
+		data, err = EncodeBody(data, []string{encoding})
+		if err != nil {
+			return err
+		}
+	}
+	buffer := &bytes.Buffer{}
+	flag := byte(0)
+	if message.Compressed {
+		flag = 1
+	}
+	buffer.WriteByte(flag)
+	_ = binary.Write(buffer, binary.BigEndian, uint32(len(data)))
+	buffer.Write(data)
+	_, err = writer.Write(buffer.Bytes())
+	return err
+}
+
+// 按grpc消息拆分报文体,每条消息触发一次事件,事件调用resolve后消息才会发出
+func (i *ProxyHttp) grpcStream(call *GrpcCall, body io.Reader, encoding string, event func(call *GrpcCall, message *GrpcMessage, resolve ResolveGrpc, conn net.Conn) error, done func()) *io.PipeReader {
+	reader, writer := io.Pipe()
+	resolve := ResolveGrpc(func(message *GrpcMessage) error {
+		return writeGrpcMessage(writer, message, encoding)
+	})
+	go func() {
+		for {
+			message, err := readGrpcMessage(body, encoding)
+			if err == io.EOF {
+				if done != nil {
+					done()
+				}
+				_ = writer.Close()
+				return
+			}
+			if err == nil {
+				if event != nil {
+					err = event(call, message, resolve, i.conn)
+				} else {
+					err = resolve(message)
+				}
+			}
+			if err != nil {
+				Log.Log.Println("处理grpc消息失败：" + err.Error())
+				_ = writer.CloseWithError(err)
+				return
+			}
+		}
+	}()
+	return reader
+}
+
+// 处理grpc请求,请求体按消息流式转发
+func (i *ProxyHttp) resolveGrpcRequest() bool {
+	i.grpcCall = NewGrpcCall(i.request, i.server.GrpcRegistry)
+	if i.server.OnGrpcRequestEvent == nil || i.request.Body == nil {
+		return true
+	}
+	encoding := i.request.Header.Get("Grpc-Encoding")
+	i.request.Body = i.grpcStream(i.grpcCall, i.request.Body, encoding, i.server.OnGrpcRequestEvent, nil)
+	i.request.ContentLength = -1
+	i.request.Header.Del("Content-Length")
+	return true
+}
+
+// 处理grpc响应,响应结束后触发OnGrpcCloseEvent,此时可以通过Status获取调用结果
+func (i *ProxyHttp) resolveGrpcResponse() bool {
+	call := i.grpcCall
+	if call == nil {
+		call = NewGrpcCall(i.request, i.server.GrpcRegistry)
+	}
+	call.Response = i.response
+	if i.server.OnGrpcResponseEvent == nil && i.server.OnGrpcCloseEvent == nil {
+		return true
+	}
+	var done func()
+	if i.server.OnGrpcCloseEvent != nil {
+		conn := i.conn
+		done = func() {
+			i.server.OnGrpcCloseEvent(call, conn)
+		}
+	}
+	encoding := i.response.Header.Get("Grpc-Encoding")
+	i.grpcPipe = i.grpcStream(call, i.response.Body, encoding, i.server.OnGrpcResponseEvent, done)
+	i.response.Body = i.grpcPipe
+	i.response.ContentLength = -1
+	i.response.Header.Del("Content-Length")
+	return true
+}
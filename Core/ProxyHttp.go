@@ -3,9 +3,9 @@ package Core
 import (
 	"bufio"
 	"bytes"
-	"compress/gzip"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -23,21 +23,31 @@ import (
 
 const ConnectSuccess = "HTTP/1.1 200 Connection Established\r\n\r\n"
 const ConnectFailed = "HTTP/1.1 502 Bad Gateway\r\n\r\n"
+const ConnectForbidden = "HTTP/1.1 403 Forbidden\r\n\r\n"
 const SslFileHost = "shermie-proxy.io"
 
 type ProxyHttp struct {
 	ConnPeer
-	request  *http.Request
-	response *http.Response
-	upgrade  *Websocket.Upgrader
-	target   net.Conn
-	tls      bool
-	port     string
+	request      *http.Request
+	response     *http.Response
+	upgrade      *Websocket.Upgrader
+	target       net.Conn
+	tls          bool
+	port         string
+	encodings    []string
+	responseBody io.ReadCloser
+	grpcCall     *GrpcCall
+	// grpc响应的消息管道,客户端停止读取时需要关闭,否则处理消息的协程会一直阻塞
+	grpcPipe *io.PipeReader
+	// 隧道中的请求为相对地址,使用隧道的目标地址补全
+	tunnel string
 }
 
 type ResolveWs func(msgType int, message []byte) error
 type ResolveHttpRequest func(message []byte, request *http.Request)
 type ResolveHttpResponse func(message []byte, response *http.Response)
+type ResolveHttpRequestStream func(body io.Reader, request *http.Request)
+type ResolveHttpResponseStream func(body io.Reader, response *http.Response)
 
 // tcp连接处理入口
 func (i *ProxyHttp) Handle() {
@@ -58,75 +68,255 @@ func (i *ProxyHttp) Handle() {
 	}
 	// 否则是普通请求
 	i.tls = false
-	i.handleRequest()
+	i.serveRequests()
 }
 
-// 处理请求入口
-func (i *ProxyHttp) handleRequest() {
-	var err error
-	if i.request == nil {
-		i.request, err = http.ReadRequest(i.reader)
-		if err != nil {
-			Log.Log.Println("读取请求错误：" + err.Error())
+// 在同一个连接上循环处理请求,直到客户端要求关闭连接或者空闲超时
+func (i *ProxyHttp) serveRequests() {
+	for {
+		if i.request.Header.Get("Upgrade") == "websocket" || i.request.Header.Get("Connection") == "Upgrade" {
+			i.handleWsRequest()
+			return
+		}
+		if i.tls || i.tunnel != "" {
+			i.request = i.SetRequest(i.request)
+		}
+		if !i.handleRequest() {
 			return
 		}
+		if !i.nextRequest() {
+			return
+		}
+	}
+}
+
+// 读取连接上的下一个请求,管道化的请求会按顺序依次读取
+func (i *ProxyHttp) nextRequest() bool {
+	// IdleTimeout为0时不限制空闲时间
+	if i.server.IdleTimeout > 0 {
+		_ = i.conn.SetReadDeadline(time.Now().Add(i.server.IdleTimeout))
+	}
+	request, err := http.ReadRequest(i.reader)
+	if err != nil {
+		if e, ok := err.(net.Error); err != io.EOF && !(ok && e.Timeout()) {
+			Log.Log.Println("读取请求错误：" + err.Error())
+		}
+		return false
 	}
+	_ = i.conn.SetReadDeadline(time.Time{})
+	i.request = request
+	return true
+}
+
+// 处理请求入口,返回连接是否可以继续复用
+func (i *ProxyHttp) handleRequest() bool {
+	var err error
 	if i.request.URL == nil {
 		Log.Log.Println("请求地址为空")
-		return
+		return false
 	}
-	if i.request.URL.Path == "/tls" {
-		response := http.Response{
-			StatusCode: http.StatusOK,
-			ProtoMajor: 1,
-			ProtoMinor: 1,
-			Header: http.Header{
-				"Content-Type":              []string{"application/x-x509-ca-cert"},
-				"Content-Disposition":       []string{"attachment;filename=cert.crt"},
-				"Content-Transfer-Encoding": []string{"binary"},
-			},
-			Body: io.NopCloser(bytes.NewReader(Cert.RootCaStr)),
-		}
-		_ = response.Write(i.conn)
-		return
+	// 客户端发送了Connection: close或者是不支持长连接的HTTP/1.0请求
+	keepAlive := !i.request.Close
+	// 证书下载页面
+	if i.isPortalRequest() {
+		return i.servePortal(keepAlive)
 	}
-	resolveRequest := ResolveHttpRequest(func(message []byte, request *http.Request) {
-		request.Body = io.NopCloser(bytes.NewReader(message))
-		request.Header.Set("Content-Length", strconv.Itoa(len(message)))
-	})
-	body, _ := i.ReadRequestBody(i.request.Body)
-	if i.server.OnHttpRequestEvent != nil {
-		resolveResult := i.server.OnHttpRequestEvent(body, i.request, resolveRequest, i.conn)
-		if !resolveResult {
-			return
+	// 请求体可能被替换,交换结束后关闭原始请求体,保证同一连接上的下一个请求可以正确读取
+	requestBody := i.request.Body
+	defer func() {
+		if requestBody != nil {
+			_ = requestBody.Close()
 		}
-	} else {
-		resolveRequest(body, i.request)
+	}()
+	ok := i.exchange()
+	defer i.closeResponse()
+	if !ok {
+		return false
+	}
+	// 远程服务器可能使用http2响应,返回给客户端时统一转换为HTTP/1.1
+	i.response.Proto = "HTTP/1.1"
+	i.response.ProtoMajor = 1
+	i.response.ProtoMinor = 1
+	if i.response.ContentLength < 0 && len(i.response.TransferEncoding) == 0 {
+		i.response.TransferEncoding = []string{"chunked"}
+	}
+	// 连接是否关闭由客户端决定,与远程服务器的连接无关
+	i.response.Close = !keepAlive
+	// HTTP/1.0客户端不支持分块传输,只能通过关闭连接标识响应结束
+	if i.response.ContentLength < 0 && !i.request.ProtoAtLeast(1, 1) {
+		i.response.TransferEncoding = nil
+		i.response.Close = true
+		keepAlive = false
+	}
+	if keepAlive && !i.request.ProtoAtLeast(1, 1) {
+		i.response.Header.Set("Connection", "keep-alive")
+	}
+	err = i.response.Write(i.conn)
+	if err != nil {
+		Log.Log.Println("返回响应数据失败：" + err.Error())
+		return false
+	}
+	i.request = nil
+	return keepAlive
+}
+
+// 调用请求、响应事件并转发请求,返回true时i.response为需要返回给客户端的响应
+func (i *ProxyHttp) exchange() bool {
+	var err error
+	i.response = nil
+	i.grpcCall = nil
+	if !i.resolveRequest() {
+		return false
 	}
 	i.response, err = i.Transport(i.request)
+	// 被路由规则禁止时返回403,客户端可以区分禁止和网络错误
+	if errors.Is(err, ErrRouteBlocked) {
+		i.response = blockedResponse(i.request)
+		return true
+	}
 	if i.response == nil {
 		Log.Log.Println("远程服务器无响应-1")
-		return
+		return false
 	}
 	if err != nil {
 		Log.Log.Println("获取远程服务器响应失败：" + err.Error())
-		return
+		return false
+	}
+	i.responseBody = i.response.Body
+	return i.resolveResponse()
+}
+
+// 请求被路由规则禁止时返回的响应
+func blockedResponse(request *http.Request) *http.Response {
+	body := []byte(ErrRouteBlocked.Error())
+	return &http.Response{
+		Status:        "403 Forbidden",
+		StatusCode:    http.StatusForbidden,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       request,
+	}
+}
+
+// 关闭远程服务器的原始响应体,使连接可以回到连接池
+func (i *ProxyHttp) closeResponse() {
+	if i.grpcPipe != nil {
+		_ = i.grpcPipe.CloseWithError(io.ErrClosedPipe)
+		i.grpcPipe = nil
+	}
+	if i.responseBody != nil {
+		_ = i.responseBody.Close()
+		i.responseBody = nil
+	}
+}
+
+// 报文体是否使用流式传输,长度未知或者超过阈值的报文体不再缓存到内存
+func (i *ProxyHttp) shouldStream(length int64) bool {
+	return i.server.StreamThreshold > 0 && (length < 0 || length > i.server.StreamThreshold)
+}
+
+// 调用请求事件,返回false表示不需要继续发送请求
+func (i *ProxyHttp) resolveRequest() bool {
+	// grpc请求按消息流式处理,不经过http请求事件
+	if IsGrpc(i.request.Header) {
+		return i.resolveGrpcRequest()
+	}
+	if i.server.OnHttpRequestStreamEvent != nil || i.shouldStream(i.request.ContentLength) {
+		resolveRequest := ResolveHttpRequestStream(func(body io.Reader, request *http.Request) {
+			if body == request.Body {
+				return
+			}
+			request.Body = i.toReadCloser(body)
+			// 替换后的请求体长度未知,使用分块传输
+			request.ContentLength = -1
+			request.Header.Del("Content-Length")
+		})
+		if i.server.OnHttpRequestStreamEvent != nil {
+			body := io.Reader(i.request.Body)
+			if body == nil {
+				body = http.NoBody
+			}
+			return i.server.OnHttpRequestStreamEvent(body, i.request, resolveRequest, i.conn)
+		}
+		// 没有注册流式事件时原样透传
+		return true
+	}
+	resolveRequest := ResolveHttpRequest(func(message []byte, request *http.Request) {
+		request.Body = io.NopCloser(bytes.NewReader(message))
+		request.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(message)), nil
+		}
+		request.ContentLength = int64(len(message))
+		request.TransferEncoding = nil
+		request.Header.Set("Content-Length", strconv.Itoa(len(message)))
+	})
+	// 必须完整读取请求体,否则无法定位同一连接上的下一个请求
+	body, err := i.ReadRequestBody(i.request.Body)
+	if err != nil {
+		Log.Log.Println("读取请求体错误：" + err.Error())
+		return false
+	}
+	if i.server.OnHttpRequestEvent != nil {
+		return i.server.OnHttpRequestEvent(body, i.request, resolveRequest, i.conn)
 	}
-	body, _ = i.ReadResponseBody(i.response)
+	resolveRequest(body, i.request)
+	return true
+}
+
+// 调用响应事件,返回false表示不需要将响应返回给客户端
+func (i *ProxyHttp) resolveResponse() bool {
+	if IsGrpc(i.response.Header) {
+		return i.resolveGrpcResponse()
+	}
+	if i.server.OnHttpResponseStreamEvent != nil || i.shouldStream(i.response.ContentLength) {
+		resolveResponse := ResolveHttpResponseStream(func(body io.Reader, response *http.Response) {
+			if body == response.Body {
+				return
+			}
+			response.Body = i.toReadCloser(body)
+			response.ContentLength = -1
+			response.TransferEncoding = []string{"chunked"}
+			response.Header.Del("Content-Length")
+		})
+		if i.server.OnHttpResponseStreamEvent != nil {
+			return i.server.OnHttpResponseStreamEvent(i.response.Body, i.response, resolveResponse, i.conn)
+		}
+		return true
+	}
+	body, _ := i.ReadResponseBody(i.response)
+	_ = i.response.Body.Close()
 	resolveResponse := ResolveHttpResponse(func(message []byte, response *http.Response) {
+		// 按原始编码重新压缩,保证响应头和响应体一致
+		if len(i.encodings) > 0 && i.server.Encoding == EncodingKeep {
+			encoded, err := EncodeBody(message, i.encodings)
+			if err != nil {
+				Log.Log.Println("编码响应体失败：" + err.Error())
+			} else {
+				message = encoded
+				response.Header.Set("Content-Encoding", strings.Join(i.encodings, ", "))
+			}
+		}
 		response.Body = io.NopCloser(bytes.NewReader(message))
+		response.ContentLength = int64(len(message))
+		response.TransferEncoding = nil
 		response.Header.Set("Content-Length", strconv.Itoa(len(message)))
 	})
 	if i.server.OnHttpResponseEvent != nil {
-		resolveResult := i.server.OnHttpResponseEvent(body, i.response, resolveResponse, i.conn)
-		if !resolveResult {
-			return
-		}
-	} else {
-		resolveResponse(body, i.response)
+		return i.server.OnHttpResponseEvent(body, i.response, resolveResponse, i.conn)
 	}
-	_ = i.response.Write(i.conn)
-	i.request = nil
+	resolveResponse(body, i.response)
+	return true
+}
+
+func (i *ProxyHttp) toReadCloser(reader io.Reader) io.ReadCloser {
+	if readCloser, ok := reader.(io.ReadCloser); ok {
+		return readCloser
+	}
+	return io.NopCloser(reader)
 }
 
 // 读取http请求体
@@ -138,17 +328,34 @@ func (i *ProxyHttp) ReadRequestBody(reader io.Reader) ([]byte, error) {
 	return body, err
 }
 
+// 读取http响应体,压缩过的响应体会被解码并移除Content-Encoding
 func (i *ProxyHttp) ReadResponseBody(response *http.Response) ([]byte, error) {
-	var reader io.Reader
-	var err error
-	reader = bufio.NewReader(response.Body)
-	if header := response.Header.Get("Content-Encoding"); header == "gzip" {
-		reader, err = gzip.NewReader(response.Body)
-		if err != nil {
-			return []byte{}, nil
-		}
+	i.encodings = nil
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return body, err
+	}
+	encodings := ContentEncodings(response.Header)
+	if len(encodings) == 0 || len(body) == 0 || !hasResponseBody(response) {
+		return body, nil
 	}
-	return io.ReadAll(reader)
+	decoded, err := DecodeBody(body, encodings)
+	if err != nil {
+		// 无法解码时原样交给事件处理
+		Log.Log.Println("解码响应体失败：" + err.Error())
+		return body, nil
+	}
+	i.encodings = encodings
+	response.Header.Del("Content-Encoding")
+	return decoded, nil
+}
+
+// HEAD请求以及204、304响应没有响应体,Content-Encoding只是描述对应的完整响应
+func hasResponseBody(response *http.Response) bool {
+	if response.Request != nil && response.Request.Method == http.MethodHead {
+		return false
+	}
+	return response.StatusCode != http.StatusNoContent && response.StatusCode != http.StatusNotModified
 }
 
 // 移除请求头
@@ -163,7 +370,6 @@ func (i *ProxyHttp) RemoveHeader(header http.Header) {
 		"Proxy-Authorization",
 		"Proxy-Authenticate",
 		"Connection",
-		"Accept-Encoding",
 	}
 	for _, value := range removeHeaders {
 		if v := header.Get(value); len(v) > 0 {
@@ -180,53 +386,104 @@ func (i *ProxyHttp) RemoveHeader(header http.Header) {
 // http请求转发
 func (i *ProxyHttp) Transport(request *http.Request) (*http.Response, error) {
 	i.RemoveHeader(request.Header)
-	transport := &http.Transport{
-		DisableKeepAlives:     true,
-		TLSHandshakeTimeout:   15 * time.Second,
-		ResponseHeaderTimeout: 30 * time.Second,
-		DialContext:           i.DialContext(),
-		TLSClientConfig:       &tls.Config{InsecureSkipVerify: true},
-	}
-	transport.DialContext = i.DialContext()
-	if i.ConnPeer.server.proxy != "" {
-		transport.Proxy = http.ProxyURL(&url.URL{Host: i.server.proxy})
-	}
-	response, err := transport.RoundTrip(request)
+	// grpc服务需要通过te头确认客户端支持trailer
+	if IsGrpc(request.Header) {
+		request.Header.Set("Te", "trailers")
+	}
+	// 只向服务器声明能够解码的编码
+	if acceptEncoding := request.Header.Get("Accept-Encoding"); acceptEncoding != "" {
+		if acceptEncoding = FilterAcceptEncoding(acceptEncoding); acceptEncoding != "" {
+			request.Header.Set("Accept-Encoding", acceptEncoding)
+		} else {
+			request.Header.Del("Accept-Encoding")
+		}
+	}
+	// 按路由规则选择出口,同一出口的请求共用连接池
+	addr := request.URL.Host
+	if request.URL.Port() == "" {
+		port := "80"
+		if request.URL.Scheme == "https" {
+			port = "443"
+		}
+		addr = net.JoinHostPort(request.URL.Hostname(), port)
+	}
+	group, err := i.server.egress(i.server.Route(i.conn.RemoteAddr(), addr))
 	if err != nil {
-		Log.Log.Println("转发http请求失败：" + err.Error())
+		Log.Log.Println("转发http请求失败：" + addr + "：" + err.Error())
 		return nil, err
 	}
-	i.RemoveHeader(response.Header)
-	return response, err
+	var tried []*UpstreamProxy
+	for {
+		var upstream *UpstreamProxy
+		proxy := ""
+		if group != nil {
+			upstream = group.Select(i.conn.RemoteAddr(), tried)
+		}
+		if upstream != nil {
+			// 分组key不包含密码,同一代理的不同账号使用不同的分组
+			proxy = upstream.URL.Redacted()
+		}
+		key := PoolKey(request.URL.Scheme, request.URL.Host, proxy, i.server.network)
+		response, err := i.server.Pool.RoundTrip(key, func() *http.Transport {
+			return i.server.newTransport(upstream)
+		}, request)
+		// 无法连接上游代理时请求还没有发出,请求体可以重放时切换到其他代理或直接连接重试
+		var unreachable *UpstreamUnreachableError
+		if err != nil && upstream != nil && errors.As(err, &unreachable) && (len(tried)+1 < len(group.Members) || group.Direct) && i.rewindBody(request) {
+			Log.Log.Println("上游代理不可用,切换到其他代理：" + err.Error())
+			tried = append(tried, upstream)
+			continue
+		}
+		if err != nil {
+			Log.Log.Println("转发http请求失败：" + err.Error())
+			return nil, err
+		}
+		i.RemoveHeader(response.Header)
+		return response, err
+	}
+}
+
+// 重置请求体用于重试,不能重置时返回false
+func (i *ProxyHttp) rewindBody(request *http.Request) bool {
+	if request.Body == nil || request.Body == http.NoBody {
+		return true
+	}
+	if request.GetBody == nil {
+		return false
+	}
+	body, err := request.GetBody()
+	if err != nil {
+		return false
+	}
+	request.Body = body
+	return true
 }
 
 // 处理tls请求
 func (i *ProxyHttp) handleSslRequest() {
 	var err error
-	if i.ConnPeer.server.proxy != "" {
-		i.target, err = net.Dial("tcp", i.server.proxy)
-	} else {
-		if i.port == "443" {
-			i.target, err = tls.Dial("tcp", i.request.Host, &tls.Config{
-				InsecureSkipVerify: true,
-			})
-		} else {
-			i.target, err = net.Dial("tcp", i.request.Host)
-		}
+	hostname, _, _ := net.SplitHostPort(i.request.Host)
+	// 只检查路由是否禁止,远程连接在隧道中按需建立,避免经过上游代理时多建立一条连接,证书页面不需要检查
+	if !strings.EqualFold(hostname, SslFileHost) {
+		_, err = i.server.egress(i.server.Route(i.conn.RemoteAddr(), i.request.Host))
 	}
 	if err != nil {
-		_, err = i.conn.Write([]byte(ConnectFailed))
+		Log.Log.Println("连接目标服务器失败：" + i.request.Host + " " + err.Error())
+		if errors.Is(err, ErrRouteBlocked) {
+			_, _ = i.conn.Write([]byte(ConnectForbidden))
+			return
+		}
+		_, _ = i.conn.Write([]byte(ConnectFailed))
 		return
 	}
-	_ = i.target.Close()
 	// 向源连接返回连接成功
 	_, err = i.conn.Write([]byte(ConnectSuccess))
 	if err != nil {
 		Log.Log.Println("返回连接状态失败：" + err.Error())
 		return
 	}
-	// 建立TLS连接并返回给源
-	i.SslReceiveSend()
+	// 按隧道中的协议分别处理,tls数据解密后返回给源
+	i.handleTunnel(i.request.Host, i.port, true, i.relayTunnel)
 }
 
 // 设置请求头
@@ -234,67 +491,114 @@ func (i *ProxyHttp) SetRequest(request *http.Request) *http.Request {
 	if request.Header != nil {
 		request.Header.Set("Connection", "false")
 	}
+	if request.Host == "" {
+		request.Host = i.tunnel
+	}
 	if request.URL != nil {
 		request.URL.Host = request.Host
-		request.URL.Scheme = "https"
+		request.URL.Scheme = "http"
+		if i.tls {
+			request.URL.Scheme = "https"
+		}
 	}
 	return request
 }
 
-func (i *ProxyHttp) tryTls() {
+func (i *ProxyHttp) tryTls() bool {
 	var err error
-	certificate, err := Cache.GetCertificate(i.request.Host, i.port)
-	if err != nil {
-		Log.Log.Println(i.request.Host + "：获取证书失败：" + err.Error())
-		return
+	// 证书按SNI生成,客户端没有发送SNI时使用CONNECT请求的地址
+	var certHost string
+	var certSent bool
+	config := &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			certHost = hello.ServerName
+			if certHost == "" {
+				certHost = i.request.Host
+				if host, _, err := net.SplitHostPort(i.request.Host); err == nil {
+					certHost = host
+				}
+			}
+			certificate, err := i.getCertificate(certHost)
+			if err != nil {
+				Log.Log.Println(certHost + "：获取证书失败：" + err.Error())
+				return nil, err
+			}
+			cert, ok := certificate.(tls.Certificate)
+			if !ok {
+				return nil, errors.New("证书格式错误")
+			}
+			certSent = true
+			return &cert, nil
+		},
 	}
-	if _, ok := certificate.(tls.Certificate); !ok {
-		return
+	// 通过ALPN协商http2
+	if i.server.Http2 {
+		config.NextProtos = []string{http2NextProto, "http/1.1"}
 	}
-	cert := certificate.(tls.Certificate)
-	sslConn := tls.Server(i.conn, &tls.Config{
-		Certificates: []tls.Certificate{cert},
-	})
+	sslConn := tls.Server(i.conn, config)
 	err = sslConn.Handshake()
 	if err != nil {
 		i.tls = false
+		// 客户端发送证书被拒绝的警报时说明校验了证书,之后该域名不再解密
+		if certSent && isCertificateRejected(err) {
+			i.server.Mitm.Learn(certHost)
+		}
 		if err == io.EOF || strings.Index(err.Error(), "closed") != -1 {
 			Log.Log.Println("客户端TLS握手失败：" + err.Error())
-			return
+			return false
 		}
 		// todo: why call handleWsHandshakeErr here?
 		// i.handleWsHandshakeErr(Utils.GetLastTimeFrame(sslConn, "rawInput"))
-		return
+		return false
 	}
-	_ = sslConn.SetDeadline(time.Now().Add(time.Second * 60))
+	i.conn = sslConn
+	i.tls = true
+	i.reader = bufio.NewReader(sslConn)
+	i.writer = bufio.NewWriter(sslConn)
+	return true
+}
 
-	reader := bufio.NewReader(sslConn)
-	request, err := http.ReadRequest(reader)
-	if err != nil {
-		if err == io.EOF {
-			Log.Log.Println("浏览器TLS连接断开：" + err.Error())
-			return
-		}
-		Log.Log.Println("读取TLS连接请求数据失败：" + err.Error())
-		return
+// 客户端拒绝证书时发送的tls警报:bad_certificate、unknown_ca、certificate_unknown
+func isCertificateRejected(err error) bool {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Err == nil {
+		return false
+	}
+	switch opErr.Err.Error() {
+	case "tls: bad certificate", "tls: unknown certificate authority", "tls: unknown certificate":
+		return opErr.Op == "remote error"
+	// openssl在tls1.3中切换密钥前发送未加密的警报,服务端解密失败
+	case "tls: bad record MAC":
+		return opErr.Op == "local error"
 	}
+	return false
+}
 
-	i.conn = sslConn
-	i.tls = true
-	i.reader = reader
-	i.request = request
+// 获取证书,开启MimicUpstreamCert时仿照远程服务器的证书生成,失败时使用默认证书
+func (i *ProxyHttp) getCertificate(host string) (interface{}, error) {
+	if i.server.MimicUpstreamCert {
+		certificate, err := Cache.GetMimicCertificate(host, i.request.Host, i.DialContext())
+		if err == nil {
+			return certificate, nil
+		}
+		Log.Log.Println(host + "：仿照远程服务器证书失败：" + err.Error())
+	}
+	return Cache.GetCertificate(host, i.port)
 }
 
 // tls数据接收发送
 func (i *ProxyHttp) SslReceiveSend() {
-	i.tryTls()
-
-	if i.request.Header.Get("Upgrade") == "websocket" || i.request.Header.Get("Connection") == "Upgrade" {
-		i.handleWsRequest()
+	if !i.tryTls() {
+		return
+	}
+	if i.conn.(*tls.Conn).ConnectionState().NegotiatedProtocol == http2NextProto {
+		i.serveHttp2()
+		return
+	}
+	if !i.nextRequest() {
 		return
 	}
-	i.request = i.SetRequest(i.request)
-	i.handleRequest()
+	i.serveRequests()
 }
 
 // 普通ws请求
@@ -445,37 +749,11 @@ func (i *ProxyHttp) handleWsRequest() bool {
 	return false
 }
 
+// 连接远程服务器,带上客户端地址用于路由匹配
 func (i *ProxyHttp) DialContext() func(ctx context.Context, network, addr string) (conn net.Conn, err error) {
-	return func(ctx context.Context, network, addr string) (conn net.Conn, err error) {
-		separator := strings.LastIndex(addr, ":")
-		ipList, err := i.server.dns.Fetch(addr[:separator])
-		var ip string
-		for _, item := range ipList {
-			ip = item.String()
-			if !strings.Contains(ip, ":") {
-				break
-			}
-		}
-		tcpAddr, _ := net.ResolveTCPAddr(network, ip+addr[separator:])
-		conn, err = net.DialTimeout(network, tcpAddr.String(), time.Duration(10)*time.Second)
-		if err != nil {
-			return conn, err
-		}
-		// 是否关闭nagle算法
-		tcpConn, ok := conn.(*net.TCPConn)
-		if ok {
-			_ = tcpConn.SetNoDelay(i.server.nagle)
-		}
-		dialer := net.Dialer{
-			Timeout:   time.Duration(30) * time.Second,
-			Deadline:  time.Time{},
-			KeepAlive: time.Duration(30) * time.Second,
-		}
-		// 指定网卡
-		if i.server.network != "" {
-			dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(i.server.network)}
-		}
-		return dialer.DialContext(ctx, network, tcpAddr.String())
+	client := i.conn.RemoteAddr()
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return i.server.DialContext(WithClientAddr(ctx, client), network, addr)
 	}
 }
 
@@ -0,0 +1,79 @@
+package Core
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/k8scat/shermie-proxy/Log"
+	"golang.org/x/net/http2"
+)
+
+const http2NextProto = "h2"
+
+// 处理http2连接,每个流作为一个独立的请求经过请求、响应事件
+func (i *ProxyHttp) serveHttp2() {
+	server := &http2.Server{
+		IdleTimeout: i.server.IdleTimeout,
+	}
+	server.ServeConn(i.conn, &http2.ServeConnOpts{
+		Handler: http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			// 同一连接上的流是并发处理的,每个流使用独立的处理对象
+			stream := &ProxyHttp{
+				ConnPeer: i.ConnPeer,
+				tls:      i.tls,
+				port:     i.port,
+				tunnel:   i.tunnel,
+			}
+			stream.request = stream.SetRequest(request)
+			if stream.isPortalRequest() {
+				stream.servePortalHttp2(writer)
+				return
+			}
+			stream.handleHttp2Request(writer)
+		}),
+	})
+}
+
+// 处理http2流
+func (i *ProxyHttp) handleHttp2Request(writer http.ResponseWriter) {
+	ok := i.exchange()
+	defer i.closeResponse()
+	// 事件拒绝响应时也已经有了响应对象,不返回状态码时http2会默认返回空的200
+	if !ok {
+		writer.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	header := writer.Header()
+	for key, value := range i.response.Header {
+		header[key] = value
+	}
+	header.Del("Content-Length")
+	if i.response.ContentLength >= 0 {
+		header.Set("Content-Length", strconv.FormatInt(i.response.ContentLength, 10))
+	}
+	writer.WriteHeader(i.response.StatusCode)
+	_, err := io.Copy(&flushWriter{writer: writer}, i.response.Body)
+	if err != nil {
+		Log.Log.Println("返回http2响应数据失败：" + err.Error())
+		return
+	}
+	// 响应体读取完成后才能拿到trailer,只使用TrailerPrefix声明,避免重复发送
+	header.Del("Trailer")
+	for key, value := range i.response.Trailer {
+		header[http.TrailerPrefix+key] = value
+	}
+}
+
+// 每次写入后立即发送,保证流式响应的实时性
+type flushWriter struct {
+	writer http.ResponseWriter
+}
+
+func (i *flushWriter) Write(buff []byte) (int, error) {
+	n, err := i.writer.Write(buff)
+	if flusher, ok := i.writer.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
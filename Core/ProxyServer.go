@@ -2,15 +2,18 @@ package Core
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/k8scat/shermie-proxy/Contract"
 	"github.com/k8scat/shermie-proxy/Log"
-	"github.com/viki-org/dnscache"
 )
 
 var proxyIsSet bool
@@ -18,9 +21,17 @@ var lock = &sync.Mutex{}
 
 type HttpRequestEvent func(message []byte, request *http.Request, resolve ResolveHttpRequest, conn net.Conn) bool
 type HttpResponseEvent func(message []byte, response *http.Response, resolve ResolveHttpResponse, conn net.Conn) bool
+type HttpRequestStreamEvent func(body io.Reader, request *http.Request, resolve ResolveHttpRequestStream, conn net.Conn) bool
+type HttpResponseStreamEvent func(body io.Reader, response *http.Response, resolve ResolveHttpResponseStream, conn net.Conn) bool
+
+type GrpcRequestEvent func(call *GrpcCall, message *GrpcMessage, resolve ResolveGrpc, conn net.Conn) error
+type GrpcResponseEvent func(call *GrpcCall, message *GrpcMessage, resolve ResolveGrpc, conn net.Conn) error
+type GrpcCloseEvent func(call *GrpcCall, conn net.Conn)
 
 type Socks5ResponseEvent func(message []byte, resolve ResolveSocks5, conn net.Conn) (int, error)
 type Socks5RequestEvent func(message []byte, resolve ResolveSocks5, conn net.Conn) (int, error)
+type Socks5UdpRequestEvent func(message []byte, target string, resolve ResolveSocks5Udp, conn net.Conn) (int, error)
+type Socks5UdpResponseEvent func(message []byte, source string, resolve ResolveSocks5Udp, conn net.Conn) (int, error)
 
 type WsRequestEvent func(msgType int, message []byte, resolve ResolveWs, conn net.Conn) error
 type WsResponseEvent func(msgType int, message []byte, resolve ResolveWs, conn net.Conn) error
@@ -39,36 +50,89 @@ const (
 	MethodOptions = 0x4F
 	MethodHead    = 0x48
 	SocksFive     = 0x5
+	SocksFour     = 0x4
 )
 
 type ProxyServer struct {
-	nagle                  bool
-	to                     string
-	proxy                  string
-	port                   string
-	network                string
-	listener               *net.TCPListener
-	dns                    *dnscache.Resolver
-	OnHttpRequestEvent     HttpRequestEvent
-	OnHttpResponseEvent    HttpResponseEvent
-	OnWsRequestEvent       WsRequestEvent
-	OnWsResponseEvent      WsResponseEvent
-	OnSocks5ResponseEvent  Socks5ResponseEvent
-	OnSocks5RequestEvent   Socks5RequestEvent
-	OnTcpConnectEvent      TcpConnectEvent
-	OnTcpCloseEvent        TcpClosetEvent
-	OnTcpServerStreamEvent TcpServerStreamEvent
-	OnTcpClientStreamEvent TcpClientStreamEvent
+	nagle                     bool
+	to                        string
+	port                      string
+	network                   string
+	listener                  *net.TCPListener
+	proxyErr                  error
+	proxyApplied              bool
+	SystemProxy               bool
+	IdleTimeout               time.Duration
+	Pool                      *UpstreamPool
+	StreamThreshold           int64
+	Encoding                  int
+	Http2                     bool
+	GrpcRegistry              *GrpcRegistry
+	Socks5Auth                Socks5Authenticator
+	Socks5BindTimeout         time.Duration
+	Socks5BindAllow           []string
+	Socks5Mitm                bool
+	SniffTimeout              time.Duration
+	Mitm                      *MitmPolicy
+	MimicUpstreamCert         bool
+	Resolver                  Resolver
+	Upstream                  *UpstreamProxy
+	Upstreams                 *UpstreamGroup
+	Routes                    []*Route
+	Pac                       *PacScript
+	OnHttpRequestEvent        HttpRequestEvent
+	OnHttpResponseEvent       HttpResponseEvent
+	OnHttpRequestStreamEvent  HttpRequestStreamEvent
+	OnHttpResponseStreamEvent HttpResponseStreamEvent
+	OnGrpcRequestEvent        GrpcRequestEvent
+	OnGrpcResponseEvent       GrpcResponseEvent
+	OnGrpcCloseEvent          GrpcCloseEvent
+	OnWsRequestEvent          WsRequestEvent
+	OnWsResponseEvent         WsResponseEvent
+	OnSocks5ResponseEvent     Socks5ResponseEvent
+	OnSocks5RequestEvent      Socks5RequestEvent
+	OnSocks5UdpRequestEvent   Socks5UdpRequestEvent
+	OnSocks5UdpResponseEvent  Socks5UdpResponseEvent
+	OnTcpConnectEvent         TcpConnectEvent
+	OnTcpCloseEvent           TcpClosetEvent
+	OnTcpServerStreamEvent    TcpServerStreamEvent
+	OnTcpClientStreamEvent    TcpClientStreamEvent
 }
 
 func NewProxyServer(port string, nagle bool, proxy string, to string, network string) *ProxyServer {
+	var upstream *UpstreamProxy
+	var upstreams *UpstreamGroup
+	var err error
+	// 多个上游代理使用逗号分隔,组成代理组
+	if strings.Contains(proxy, ",") {
+		upstreams, err = ParseUpstreamGroup(proxy, StrategyRoundRobin)
+	} else if proxy != "" {
+		upstream, err = ParseUpstreamProxy(proxy)
+	}
 	return &ProxyServer{
 		port:    port,
-		dns:     dnscache.New(time.Minute * 5),
 		nagle:   nagle,
-		proxy:   proxy,
 		to:      to,
 		network: network,
+		// 客户端长连接的空闲超时时间,为0时不限制
+		IdleTimeout: time.Second * 60,
+		Pool:        NewUpstreamPool(),
+		// 解密后的连接默认支持http2
+		Http2: true,
+		// bind命令等待目标服务器连入的超时时间
+		Socks5BindTimeout: time.Minute * 2,
+		// 隧道建立后等待客户端首个数据包的时间,超时后按普通数据转发
+		SniffTimeout: time.Second,
+		Mitm:         NewMitmPolicy(),
+		// 出站连接、路由和PAC脚本使用同一个域名解析
+		Resolver: NewDnsResolver(),
+		// 所有出站连接都经过上游代理
+		Upstream:  upstream,
+		Upstreams: upstreams,
+		// 上游代理地址错误时拒绝启动,不能回退为直接连接
+		proxyErr: err,
+		// 默认不修改系统设置,为true时启动时安装根证书并设置系统代理,Stop时恢复
+		SystemProxy: false,
 	}
 }
 
@@ -79,13 +143,18 @@ func (i *ProxyServer) beforeStart() {
 	}()
 	if !proxyIsSet {
 		i.Logo()
-		// i.Install()
+		if i.SystemProxy {
+			i.Install()
+		}
 		proxyIsSet = true
 	}
 
 }
 
 func (i *ProxyServer) Start() error {
+	if i.proxyErr != nil {
+		return i.proxyErr
+	}
 	i.beforeStart()
 	Log.Log.Println("0.0.0.0:" + i.port)
 	tcpAddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf(":%s", i.port))
@@ -97,15 +166,156 @@ func (i *ProxyServer) Start() error {
 		return fmt.Errorf("%w", err)
 	}
 	i.listener = listener
+	go i.Pool.Run()
+	for _, group := range i.groups() {
+		go group.Run(i.newTransport)
+	}
 	i.MultiListen()
 	select {}
 }
 
 func (i *ProxyServer) Stop() error {
 	i.UnInstall()
+	i.Pool.Close()
+	for _, group := range i.groups() {
+		group.Close()
+	}
 	return nil
 }
 
+// 需要健康检查的代理组
+func (i *ProxyServer) groups() []*UpstreamGroup {
+	var groups []*UpstreamGroup
+	if i.Upstreams != nil {
+		groups = append(groups, i.Upstreams)
+	}
+	for _, route := range i.Routes {
+		if route.Group != nil {
+			groups = append(groups, route.Group)
+		}
+	}
+	return groups
+}
+
+// 上游连接池统计数据
+func (i *ProxyServer) PoolStats() PoolStats {
+	return i.Pool.Stats()
+}
+
+// 连接远程服务器,按路由规则选择直接连接、通过上游代理连接或拒绝连接
+func (i *ProxyServer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	client := ClientAddr(ctx)
+	group, err := i.egress(i.Route(client, addr))
+	if err != nil {
+		return nil, err
+	}
+	if group == nil {
+		return i.DialDirect(ctx, network, addr)
+	}
+	return group.Dial(ctx, client, func(upstream *UpstreamProxy) (net.Conn, error) {
+		return i.dialUpstream(ctx, upstream, network, addr)
+	})
+}
+
+// 通过指定的上游代理连接,upstream为nil时直接连接
+func (i *ProxyServer) dialUpstream(ctx context.Context, upstream *UpstreamProxy, network, addr string) (net.Conn, error) {
+	if upstream == nil {
+		return i.DialDirect(ctx, network, addr)
+	}
+	if upstream.ResolveLocally() {
+		var err error
+		addr, err = i.resolveAddr(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return upstream.Dial(ctx, i.DialDirect, network, addr)
+}
+
+// 创建通过指定上游代理发送请求的Transport,upstream为nil时直接连接
+func (i *ProxyServer) newTransport(upstream *UpstreamProxy) *http.Transport {
+	transport := newUpstreamTransport(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return i.dialUpstream(ctx, upstream, network, addr)
+	})
+	// http代理直接转发明文请求,其他请求和协议通过隧道连接
+	if upstream != nil && upstream.URL.Scheme == UpstreamHttp {
+		transport.Proxy = http.ProxyURL(upstream.URL)
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := upstream.DialProxy(ctx, i.DialDirect)
+			if err != nil {
+				return nil, err
+			}
+			return upstream.track(conn), nil
+		}
+	}
+	return transport
+}
+
+// 解析域名,优先使用ipv4地址
+func (i *ProxyServer) resolve(ctx context.Context, host string) (string, error) {
+	if net.ParseIP(host) != nil {
+		return host, nil
+	}
+	ipList, err := i.Resolver.LookupIP(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	if len(ipList) == 0 {
+		return "", errors.New("没有解析结果：" + host)
+	}
+	ip := ipList[0]
+	for _, item := range ipList {
+		if item.To4() != nil {
+			ip = item
+			break
+		}
+	}
+	return ip.String(), nil
+}
+
+// 解析地址中的域名,返回ip:port
+func (i *ProxyServer) resolveAddr(ctx context.Context, addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	ip, err := i.resolve(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(ip, port), nil
+}
+
+// 直接连接远程服务器
+func (i *ProxyServer) DialDirect(ctx context.Context, network, addr string) (net.Conn, error) {
+	addr, err := i.resolveAddr(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	tcpAddr, err := net.ResolveTCPAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	dialer := net.Dialer{
+		Timeout:   time.Duration(30) * time.Second,
+		Deadline:  time.Time{},
+		KeepAlive: time.Duration(30) * time.Second,
+	}
+	// 指定网卡
+	if i.network != "" {
+		dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(i.network)}
+	}
+	conn, err := dialer.DialContext(ctx, network, tcpAddr.String())
+	if err != nil {
+		return nil, err
+	}
+	// 是否关闭nagle算法
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		_ = tcpConn.SetNoDelay(i.nagle)
+	}
+	return conn, nil
+}
+
 func (i *ProxyServer) Logo() {
 	logo := ` 
  ______     __  __     ______     ______     __    __     __     ______                   ______   ______     ______     __  __     __  __ 
@@ -162,6 +372,8 @@ func (i *ProxyServer) handle(conn net.Conn) {
 		process = &ProxyHttp{ConnPeer: peer}
 	case SocksFive:
 		process = &ProxySocks5{ConnPeer: peer}
+	case SocksFour:
+		process = &ProxySocks4{ProxySocks5: ProxySocks5{ConnPeer: peer}}
 	default:
 		process = &ProxyTcp{ConnPeer: peer}
 	}
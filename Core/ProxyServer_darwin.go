@@ -5,7 +5,7 @@ import (
 )
 
 func (i *ProxyServer) Install() {
-	Log.Log.Println("非windows系统请手动安装证书并设置代理,可以在根目录或访问http://127.0.0.1/tls获取证书文件")
+	Log.Log.Println("非windows系统请手动安装证书并设置代理,可以在根目录或访问http://127.0.0.1:" + i.port + "/获取证书文件和安装步骤")
 }
 
 func (i *ProxyServer) UnInstall() {
@@ -0,0 +1,39 @@
+package Core
+
+import (
+	"fmt"
+
+	"github.com/k8scat/shermie-proxy/Log"
+	"github.com/k8scat/shermie-proxy/Utils"
+)
+
+func (i *ProxyServer) Install() {
+	err := Utils.InstallCert(Cert.CertFile)
+	if err != nil {
+		Log.Log.Println("安装系统证书失败：" + err.Error())
+		return
+	}
+	Log.Log.Println("已安装系统证书")
+	// 设置失败时可能已经修改了部分设置,同样需要恢复
+	i.proxyApplied = true
+	err = Utils.SetSystemProxy(fmt.Sprintf("127.0.0.1:%s", i.port))
+	if err != nil {
+		Log.Log.Println("设置系统代理失败：" + err.Error())
+		return
+	}
+	Log.Log.Println("已设置系统代理")
+}
+
+func (i *ProxyServer) UnInstall() {
+	// 只恢复本服务设置过的系统代理,避免覆盖用户自己的设置
+	if !i.proxyApplied {
+		return
+	}
+	i.proxyApplied = false
+	err := Utils.SetSystemProxy("")
+	if err != nil {
+		Log.Log.Println("恢复系统代理失败：" + err.Error())
+		return
+	}
+	Log.Log.Println("已恢复系统代理")
+}
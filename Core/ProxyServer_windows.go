@@ -15,6 +15,7 @@ func (i *ProxyServer) Install() {
 			return
 		}
 		Log.Log.Println("已安装系统证书")
+		i.proxyApplied = true
 		err = Utils.SetSystemProxy(fmt.Sprintf("127.0.0.1:%s", i.port))
 		if err != nil {
 			Log.Log.Println(err.Error())
@@ -23,11 +24,13 @@ func (i *ProxyServer) Install() {
 		Log.Log.Println("已设置系统代理")
 		return
 	}
-	Log.Log.Println("非windows系统请手动安装证书并设置代理,可以在根目录或访问http://127.0.0.1/tls获取证书文件")
+	Log.Log.Println("非windows系统请手动安装证书并设置代理,可以在根目录或访问http://127.0.0.1:" + i.port + "/获取证书文件和安装步骤")
 }
 
 func (i *ProxyServer) UnInstall() {
-	if runtime.GOOS == "windows" {
+	// 只关闭本服务设置过的系统代理
+	if runtime.GOOS == "windows" && i.proxyApplied {
+		i.proxyApplied = false
 		err := Utils.SetSystemProxy("")
 		if err != nil {
 			Log.Log.Println(err.Error())
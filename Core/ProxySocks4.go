@@ -0,0 +1,117 @@
+package Core
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/k8scat/shermie-proxy/Log"
+)
+
+// socks4和socks4a代理,与socks5共用数据转发和事件
+type ProxySocks4 struct {
+	ProxySocks5
+}
+
+const (
+	Socks4Version = 0x04
+	// 应答版本号
+	Socks4ReplyVersion = 0x00
+	Socks4Granted      = 0x5A
+	Socks4Rejected     = 0x5B
+	// userid和域名的最大长度
+	Socks4MaxField = 255
+)
+
+func (i *ProxySocks4) Handle() {
+	// 请求格式为 版本号、命令、2字节端口、4字节ip、userid、0x00,socks4a在之后追加域名、0x00
+	header := make([]byte, 8)
+	_, err := io.ReadFull(i.reader, header)
+	if err != nil {
+		Log.Log.Println("读取socks4请求错误：" + err.Error())
+		return
+	}
+	if header[0] != Socks4Version {
+		Log.Log.Println("socks4版本号不匹配")
+		return
+	}
+	command := header[1]
+	i.port = strconv.Itoa(int(binary.BigEndian.Uint16(header[2:4])))
+	ip := net.IP(header[4:8])
+	userid, err := i.readField()
+	if err != nil {
+		Log.Log.Println("读取socks4 userid错误：" + err.Error())
+		return
+	}
+	host := ip.String()
+	// ip为0.0.0.x且x不为0时表示socks4a,目标地址为后面的域名
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		host, err = i.readField()
+		if err != nil || host == "" {
+			Log.Log.Println("读取socks4a域名错误")
+			return
+		}
+	}
+	address := net.JoinHostPort(host, i.port)
+	// socks4无法携带密码,开启认证后拒绝socks4请求
+	if i.server.Socks5Auth != nil {
+		Log.Log.Println("已开启socks5认证，拒绝socks4请求：" + i.conn.RemoteAddr().String())
+		_ = i.reply4(false, nil)
+		return
+	}
+	if userid != "" {
+		i.conn = &AuthConn{Conn: i.conn, Username: userid}
+	}
+	switch command {
+	case CommandConn:
+		i.handleConnect(address)
+	case CommandBind:
+		i.handleBind(address, i.reply4)
+	default:
+		Log.Log.Println("不支持socks4命令")
+		_ = i.reply4(false, nil)
+	}
+}
+
+func (i *ProxySocks4) handleConnect(address string) {
+	i.connect(address, i.reply4)
+}
+
+// 读取以0x00结尾的字段
+func (i *ProxySocks4) readField() (string, error) {
+	var field []byte
+	for {
+		b, err := i.reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b == 0x00 {
+			return string(field), nil
+		}
+		if len(field) >= Socks4MaxField {
+			return "", errors.New("socks4字段长度超出限制")
+		}
+		field = append(field, b)
+	}
+}
+
+// 返回应答,格式为 版本号、状态、2字节端口、4字节ip
+func (i *ProxySocks4) reply4(success bool, addr net.Addr) error {
+	buff := []byte{Socks4ReplyVersion, Socks4Rejected, 0, 0, 0, 0, 0, 0}
+	if success {
+		buff[1] = Socks4Granted
+	}
+	if addr, ok := addr.(*net.TCPAddr); ok {
+		binary.BigEndian.PutUint16(buff[2:4], uint16(addr.Port))
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			copy(buff[4:8], ip4)
+		}
+	}
+	_, err := i.writer.Write(buff)
+	if err != nil {
+		return err
+	}
+	return i.writer.Flush()
+}
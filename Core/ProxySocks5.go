@@ -1,13 +1,13 @@
 package Core
 
 import (
-	"crypto/tls"
+	"bytes"
+	"context"
 	"errors"
-	"fmt"
+	"io"
 	"net"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/k8scat/shermie-proxy/Log"
 )
@@ -35,6 +35,7 @@ const (
 )
 
 const (
+	NoAuthRequired        = 0x00
 	GssApi                = 0x01
 	UsernamePassword      = 0x02
 	IanaAssignedMin       = 0x03
@@ -44,6 +45,20 @@ const (
 	NoAcceptMethod        = 0xFF
 )
 
+const (
+	// 账号密码子协商版本号
+	AuthVersion = 0x01
+	AuthSuccess = 0x00
+	AuthFailure = 0x01
+)
+
+const (
+	// 应答状态
+	ReplySuccess            = 0x00
+	ReplyFailure            = 0x01
+	ReplyCommandUnsupported = 0x07
+)
+
 const SocketServer = "server"
 const SocketClient = "client"
 
@@ -62,34 +77,8 @@ func (i *ProxySocks5) Handle() {
 		Log.Log.Println("socks5版本号不匹配")
 		return
 	}
-	// 读取支持的方法
-	methodNum, err := i.reader.ReadByte()
-	if err != nil {
-		Log.Log.Println("读取socks5支持方法数量错误：" + err.Error())
-		return
-	}
-	if methodNum < 0 || methodNum > 0xFF {
-		Log.Log.Println("socks5支持方法参数错误")
-		return
-	}
-	// 代理默认不需要账号密码验证
-	var requiredAuth bool = false
-	// 读取所有的方法列表
-	for n := 0; n < int(methodNum); n++ {
-		_, err := i.reader.ReadByte()
-		if err != nil {
-			Log.Log.Println("读取socks5支持错误：" + err.Error())
-			return
-		}
-	}
-	_, err = i.writer.Write([]byte{Version, 0x00})
-	if err != nil {
-		Log.Log.Println("返回数据错误：" + err.Error())
-		return
-	}
-	_ = i.writer.Flush()
-	if requiredAuth {
-		// TODO 账号密码验证
+	// 协商认证方法
+	if !i.negotiate() {
 		return
 	}
 	// 读取版本号
@@ -106,6 +95,7 @@ func (i *ProxySocks5) Handle() {
 	}
 	if command != CommandConn && command != CommandBind && command != CommandUdp {
 		Log.Log.Println("不支持socks5命令")
+		_ = i.reply(ReplyCommandUnsupported, nil)
 		return
 	}
 	// 读取保留位
@@ -125,6 +115,8 @@ func (i *ProxySocks5) Handle() {
 		return
 	}
 	var hostname string
+	// 客户端请求的域名,解密时用于生成证书
+	var domain string
 	switch targetType {
 	case TargetIpv4:
 		buffer := make([]byte, 4)
@@ -159,12 +151,16 @@ func (i *ProxySocks5) Handle() {
 			Log.Log.Println("读取域名地址错误")
 			return
 		}
-		addr, err := net.ResolveIPAddr("ip", string(buffer))
-		if err != nil {
-			Log.Log.Println("读取域名地址错误：" + err.Error())
-			hostname = string(buffer)
-		} else {
-			hostname = addr.String()
+		domain = string(buffer)
+		hostname = domain
+		// CONNECT的域名由DialContext解析,设置了上游代理时交给上游代理解析
+		if command != CommandConn {
+			ip, err := i.server.resolve(context.Background(), domain)
+			if err != nil {
+				Log.Log.Println("读取域名地址错误：" + err.Error())
+			} else {
+				hostname = ip
+			}
 		}
 		break
 	}
@@ -176,69 +172,198 @@ func (i *ProxySocks5) Handle() {
 		return
 	}
 	i.port = strconv.Itoa(int(i.ByteToInt(buffer)))
-	hostname = fmt.Sprintf("%s:%s", hostname, i.port)
-	// 写入版本号
-	_ = i.writer.WriteByte(Version)
+	hostname = net.JoinHostPort(hostname, i.port)
 	if command == CommandUdp {
-		i.target, err = net.DialTimeout("udp", hostname, time.Second*30)
-	} else {
-		if i.port == "443" {
-			dialer := &net.Dialer{
-				Timeout: time.Second * 30,
-			}
-			i.target, err = tls.DialWithDialer(dialer, "tcp", hostname, &tls.Config{
-				InsecureSkipVerify: true,
-			})
-		} else {
-			i.target, err = net.DialTimeout("tcp", hostname, time.Second*30)
+		i.handleUdpAssociate(hostname)
+		return
+	}
+	if command == CommandBind {
+		i.handleBind(hostname, i.bindReply)
+		return
+	}
+	i.connect(hostname, func(success bool, addr net.Addr) error {
+		if success {
+			return i.reply(ReplySuccess, addr)
 		}
+		return i.reply(ReplyFailure, nil)
+	})
+}
+
+// 建立隧道,开启解密时只检查路由,远程连接在转发时才建立,解密的请求使用连接池,避免多建立一条上游连接
+func (i *ProxySocks5) connect(address string, reply func(success bool, addr net.Addr) error) {
+	Log.Log.Println("待连接的目标服务器：" + address)
+	var err error
+	if i.server.Socks5Mitm {
+		_, err = i.server.egress(i.server.Route(i.conn.RemoteAddr(), address))
+	} else {
+		i.target, err = i.server.DialContext(WithClientAddr(context.Background(), i.conn.RemoteAddr()), "tcp", address)
 	}
-	Log.Log.Println("待连接的目标服务器：" + hostname)
-	// 写入Rep
 	if err != nil {
-		Log.Log.Println("连接目标服务器失败：" + hostname + " " + err.Error())
-		_ = i.writer.WriteByte(0x01)
-		_ = i.writer.Flush()
+		Log.Log.Println("连接目标服务器失败：" + address + " " + err.Error())
+		_ = reply(false, nil)
 		return
-	} else {
-		_ = i.writer.WriteByte(0x00)
 	}
 	defer func() {
-		i.target.Close()
+		if i.target != nil {
+			_ = i.target.Close()
+		}
 	}()
-	// 写入Rsv
-	_ = i.writer.WriteByte(Rsv)
-	remoteAddr := i.target.RemoteAddr().String()
-	host, _, _ := net.SplitHostPort(remoteAddr)
-	if i.IpV4(host) {
-		_ = i.writer.WriteByte(TargetIpv4)
-		_, _ = i.writer.Write(net.ParseIP(host).To4())
-	}
-	if i.IpV6(host) {
-		_ = i.writer.WriteByte(TargetIpv6)
-		_, _ = i.writer.Write(net.ParseIP(host).To16())
-	}
-	if !i.IpV4(host) && !i.IpV6(host) {
-		_ = i.writer.WriteByte(TargetDomain)
-		_ = i.writer.WriteByte(byte(len(hostname)))
-		_, _ = i.writer.WriteString(hostname)
-	}
-	// 写入端口
-	_, _ = i.writer.Write(buffer)
-	err = i.writer.Flush()
+	// 应答中的地址为代理连接目标服务器使用的本地地址,还没有连接时使用代理的监听地址
+	bound := i.conn.LocalAddr()
+	if i.target != nil {
+		bound = i.target.LocalAddr()
+	}
+	err = reply(true, bound)
 	if err != nil {
-		Log.Log.Println("写入socks5握手错误：" + err.Error())
+		Log.Log.Println("写入socks应答错误：" + err.Error())
 		return
 	}
-	out := make(chan error, 1)
-	if command == 0x01 {
-		go i.Transport(out, i.conn, i.target, SocketClient)
-		go i.Transport(out, i.target, i.conn, SocketServer)
+	i.handleTunnel(address, i.port, i.server.Socks5Mitm, func() {
+		i.relay(address)
+	})
+}
+
+// 转发socks数据,解密时没有预先连接的目标服务器在这里连接
+func (i *ProxySocks5) relay(address string) {
+	if i.target == nil {
+		target, err := i.server.DialContext(WithClientAddr(context.Background(), i.conn.RemoteAddr()), "tcp", address)
+		if err != nil {
+			Log.Log.Println("连接目标服务器失败：" + address + " " + err.Error())
+			return
+		}
+		i.target = target
 	}
-	err = <-out
+	out := make(chan error, 2)
+	go i.Transport(out, i.conn, i.target, SocketClient)
+	go i.Transport(out, i.target, i.conn, SocketServer)
+	err := <-out
 	Log.Log.Println("代理socks5数据错误：" + err.Error())
 }
 
+// 返回命令应答,格式为 版本号、状态、保留位、地址类型、地址、端口
+func (i *ProxySocks5) reply(rep byte, addr net.Addr) error {
+	var ip net.IP
+	var port int
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = addr.IP, addr.Port
+	case *net.UDPAddr:
+		ip, port = addr.IP, addr.Port
+	}
+	_, err := i.writer.Write(AppendSocks5Addr([]byte{Version, rep, Rsv}, ip, port))
+	if err != nil {
+		return err
+	}
+	return i.writer.Flush()
+}
+
+func (i *ProxySocks5) bindReply(success bool, addr net.Addr) error {
+	if success {
+		return i.reply(ReplySuccess, addr)
+	}
+	return i.reply(ReplyFailure, nil)
+}
+
+// 按socks5格式追加地址类型、地址、端口,ip为空时写入0.0.0.0
+func AppendSocks5Addr(buff []byte, ip net.IP, port int) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		buff = append(buff, TargetIpv4)
+		buff = append(buff, ip4...)
+	} else if ip != nil {
+		buff = append(buff, TargetIpv6)
+		buff = append(buff, ip.To16()...)
+	} else {
+		buff = append(buff, TargetIpv4, 0, 0, 0, 0)
+	}
+	return append(buff, byte(port>>8), byte(port))
+}
+
+// 读取客户端支持的方法并选择认证方法,设置了Socks5Auth时必须使用账号密码认证
+func (i *ProxySocks5) negotiate() bool {
+	methodNum, err := i.reader.ReadByte()
+	if err != nil {
+		Log.Log.Println("读取socks5支持方法数量错误：" + err.Error())
+		return false
+	}
+	methods := make([]byte, methodNum)
+	_, err = io.ReadFull(i.reader, methods)
+	if err != nil {
+		Log.Log.Println("读取socks5支持方法错误：" + err.Error())
+		return false
+	}
+	var method byte = NoAuthRequired
+	if i.server.Socks5Auth != nil {
+		method = UsernamePassword
+	}
+	if !bytes.Contains(methods, []byte{method}) {
+		Log.Log.Println("客户端不支持socks5认证方法：" + i.conn.RemoteAddr().String())
+		_, _ = i.writer.Write([]byte{Version, NoAcceptMethod})
+		_ = i.writer.Flush()
+		return false
+	}
+	_, err = i.writer.Write([]byte{Version, method})
+	if err == nil {
+		err = i.writer.Flush()
+	}
+	if err != nil {
+		Log.Log.Println("返回数据错误：" + err.Error())
+		return false
+	}
+	if method == UsernamePassword {
+		return i.authenticate()
+	}
+	return true
+}
+
+// 账号密码认证,格式为 版本号、账号长度、账号、密码长度、密码
+func (i *ProxySocks5) authenticate() bool {
+	version, err := i.reader.ReadByte()
+	if err != nil || version != AuthVersion {
+		Log.Log.Println("socks5认证版本号错误")
+		return false
+	}
+	username, err := i.readAuthField()
+	if err != nil {
+		Log.Log.Println("读取socks5账号错误：" + err.Error())
+		return false
+	}
+	password, err := i.readAuthField()
+	if err != nil {
+		Log.Log.Println("读取socks5密码错误：" + err.Error())
+		return false
+	}
+	if !i.server.Socks5Auth.Authenticate(username, password) {
+		Log.Log.Println("socks5认证失败：" + username + " " + i.conn.RemoteAddr().String())
+		_, _ = i.writer.Write([]byte{AuthVersion, AuthFailure})
+		_ = i.writer.Flush()
+		return false
+	}
+	_, err = i.writer.Write([]byte{AuthVersion, AuthSuccess})
+	if err == nil {
+		err = i.writer.Flush()
+	}
+	if err != nil {
+		Log.Log.Println("返回数据错误：" + err.Error())
+		return false
+	}
+	// 后续事件中可以通过Username(conn)获取账号
+	i.conn = &AuthConn{Conn: i.conn, Username: username}
+	return true
+}
+
+func (i *ProxySocks5) readAuthField() (string, error) {
+	length, err := i.reader.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	buffer := make([]byte, length)
+	_, err = io.ReadFull(i.reader, buffer)
+	if err != nil {
+		return "", err
+	}
+	return string(buffer), nil
+}
+
 func (i *ProxySocks5) Transport(out chan<- error, originConn net.Conn, targetConn net.Conn, role string) {
 	buff := make([]byte, 10*1024)
 	resolve := ResolveSocks5(func(buff []byte) (int, error) {
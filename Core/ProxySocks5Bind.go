@@ -0,0 +1,86 @@
+package Core
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/k8scat/shermie-proxy/Log"
+)
+
+// 处理bind命令,监听端口等待目标服务器连入,address为客户端声明的目标服务器地址,reply用于按协议版本返回应答
+func (i *ProxySocks5) handleBind(address string, reply func(success bool, addr net.Addr) error) {
+	localIp := i.conn.LocalAddr().(*net.TCPAddr).IP
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: localIp})
+	if err != nil {
+		Log.Log.Println("监听bind端口失败：" + err.Error())
+		_ = reply(false, nil)
+		return
+	}
+	defer func() {
+		_ = listener.Close()
+	}()
+	// 第一次应答返回监听地址
+	err = reply(true, listener.Addr())
+	if err != nil {
+		Log.Log.Println("写入bind应答错误：" + err.Error())
+		return
+	}
+	Log.Log.Println("bind监听地址：" + listener.Addr().String())
+	expect, _, _ := net.SplitHostPort(address)
+	_ = listener.SetDeadline(time.Now().Add(i.server.Socks5BindTimeout))
+	for {
+		conn, err := listener.AcceptTCP()
+		if err != nil {
+			Log.Log.Println("等待bind连接失败：" + err.Error())
+			_ = reply(false, nil)
+			return
+		}
+		peer := conn.RemoteAddr().(*net.TCPAddr)
+		if !i.bindAllowed(expect, peer.IP) {
+			Log.Log.Println("拒绝bind连接：" + peer.String())
+			_ = conn.Close()
+			continue
+		}
+		i.target = conn
+		break
+	}
+	defer func() {
+		_ = i.target.Close()
+	}()
+	// 第二次应答返回连入的地址
+	err = reply(true, i.target.RemoteAddr())
+	if err != nil {
+		Log.Log.Println("写入bind应答错误：" + err.Error())
+		return
+	}
+	out := make(chan error, 2)
+	go i.Transport(out, i.conn, i.target, SocketClient)
+	go i.Transport(out, i.target, i.conn, SocketServer)
+	err = <-out
+	Log.Log.Println("代理socks5数据错误：" + err.Error())
+}
+
+// 连入地址是客户端声明的地址或在Socks5BindAllow中时才允许
+func (i *ProxySocks5) bindAllowed(expect string, ip net.IP) bool {
+	if expectIp := net.ParseIP(expect); expectIp != nil && !expectIp.IsUnspecified() && expectIp.Equal(ip) {
+		return true
+	}
+	for _, item := range i.server.Socks5BindAllow {
+		if !strings.Contains(item, "/") {
+			if allowIp := net.ParseIP(item); allowIp != nil && allowIp.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			Log.Log.Println("解析bind白名单错误：" + err.Error())
+			continue
+		}
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,272 @@
+package Core
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/k8scat/shermie-proxy/Log"
+)
+
+type ResolveSocks5Udp func(buff []byte) (int, error)
+
+// udp报文最大长度
+const Socks5UdpBufferSize = 64 * 1024
+
+// udp中继,一个控制连接对应一个中继端口,控制连接断开后中继关闭
+type socks5UdpRelay struct {
+	proxy *ProxySocks5
+	// 与客户端通信的端口
+	conn *net.UDPConn
+	// 与目标地址通信的端口,监听在所有地址或指定的网卡上
+	remote  *net.UDPConn
+	lock    *sync.Mutex
+	client  *net.UDPAddr
+	expect  *net.UDPAddr
+	targets map[string]bool
+	// 目标地址的路由结果,是否允许发送
+	routes map[string]bool
+}
+
+// 处理udp associate命令,address为客户端声明的发送地址,可能为0.0.0.0:0
+func (i *ProxySocks5) handleUdpAssociate(address string) {
+	// 在控制连接的本地地址上监听,保证客户端可以访问
+	localIp := i.conn.LocalAddr().(*net.TCPAddr).IP
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIp})
+	if err != nil {
+		Log.Log.Println("监听udp中继端口失败：" + err.Error())
+		_ = i.reply(ReplyFailure, nil)
+		return
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	remoteAddr := &net.UDPAddr{}
+	if i.server.network != "" {
+		remoteAddr.IP = net.ParseIP(i.server.network)
+	}
+	remote, err := net.ListenUDP("udp", remoteAddr)
+	if err != nil {
+		Log.Log.Println("监听udp中继端口失败：" + err.Error())
+		_ = i.reply(ReplyFailure, nil)
+		return
+	}
+	defer func() {
+		_ = remote.Close()
+	}()
+	relay := &socks5UdpRelay{
+		proxy:   i,
+		conn:    conn,
+		remote:  remote,
+		lock:    &sync.Mutex{},
+		targets: map[string]bool{},
+		routes:  map[string]bool{},
+	}
+	clientIp := i.conn.RemoteAddr().(*net.TCPAddr).IP
+	relay.expect = &net.UDPAddr{IP: clientIp}
+	resolved, err := i.server.resolveAddr(context.Background(), address)
+	if err == nil {
+		if expect, err := net.ResolveUDPAddr("udp", resolved); err == nil {
+			if !expect.IP.IsUnspecified() {
+				relay.expect.IP = expect.IP
+			}
+			relay.expect.Port = expect.Port
+		}
+	}
+	err = i.reply(ReplySuccess, conn.LocalAddr())
+	if err != nil {
+		Log.Log.Println("写入socks5握手错误：" + err.Error())
+		return
+	}
+	Log.Log.Println("udp中继地址：" + conn.LocalAddr().String())
+	go relay.serveClient()
+	go relay.serveRemote()
+	// 控制连接不会再有数据,读取到错误说明客户端已断开
+	_, _ = io.Copy(io.Discard, i.reader)
+}
+
+// 读取客户端发出的报文,其他地址发来的报文直接丢弃
+func (i *socks5UdpRelay) serveClient() {
+	buff := make([]byte, Socks5UdpBufferSize)
+	for {
+		n, from, err := i.conn.ReadFromUDP(buff)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				Log.Log.Println("读取udp数据错误：" + err.Error())
+			}
+			return
+		}
+		if i.isClient(from) {
+			packet := make([]byte, n)
+			copy(packet, buff[:n])
+			i.handleRequest(packet)
+		}
+	}
+}
+
+// 读取目标地址返回的报文
+func (i *socks5UdpRelay) serveRemote() {
+	buff := make([]byte, Socks5UdpBufferSize)
+	for {
+		n, from, err := i.remote.ReadFromUDP(buff)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				Log.Log.Println("读取udp数据错误：" + err.Error())
+			}
+			return
+		}
+		packet := make([]byte, n)
+		copy(packet, buff[:n])
+		i.handleResponse(packet, from)
+	}
+}
+
+// 第一个来自控制连接客户端ip的报文确定客户端的udp地址
+func (i *socks5UdpRelay) isClient(from *net.UDPAddr) bool {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if i.client != nil {
+		return i.client.IP.Equal(from.IP) && i.client.Port == from.Port
+	}
+	if !i.expect.IP.Equal(from.IP) || (i.expect.Port != 0 && i.expect.Port != from.Port) {
+		return false
+	}
+	i.client = from
+	return true
+}
+
+// 处理客户端发出的报文,解析头部后发往目标地址
+func (i *socks5UdpRelay) handleRequest(packet []byte) {
+	frag, target, data, err := ParseSocks5UdpHeader(packet)
+	if err != nil {
+		Log.Log.Println("解析udp报文错误：" + err.Error())
+		return
+	}
+	// 不支持分片,直接丢弃
+	if frag != 0 {
+		Log.Log.Println("不支持udp分片报文，已丢弃")
+		return
+	}
+	if !i.allow(target) {
+		return
+	}
+	resolved, err := i.proxy.server.resolveAddr(context.Background(), target)
+	if err != nil {
+		Log.Log.Println("解析udp目标地址错误：" + err.Error())
+		return
+	}
+	targetAddr, err := net.ResolveUDPAddr("udp", resolved)
+	if err != nil {
+		Log.Log.Println("解析udp目标地址错误：" + err.Error())
+		return
+	}
+	i.lock.Lock()
+	i.targets[targetAddr.String()] = true
+	i.lock.Unlock()
+	resolve := ResolveSocks5Udp(func(buff []byte) (int, error) {
+		return i.remote.WriteToUDP(buff, targetAddr)
+	})
+	if i.proxy.server.OnSocks5UdpRequestEvent != nil {
+		_, err = i.proxy.server.OnSocks5UdpRequestEvent(data, target, resolve, i.proxy.conn)
+	} else {
+		_, err = resolve(data)
+	}
+	if err != nil {
+		Log.Log.Println("发送udp数据错误：" + err.Error())
+	}
+}
+
+// 按路由规则检查目标地址,上游代理不支持转发udp,被禁止或需要通过上游代理的报文直接丢弃
+func (i *socks5UdpRelay) allow(target string) bool {
+	i.lock.Lock()
+	allowed, ok := i.routes[target]
+	i.lock.Unlock()
+	if ok {
+		return allowed
+	}
+	server := i.proxy.server
+	group, err := server.egress(server.Route(i.proxy.conn.RemoteAddr(), target))
+	// PAC结果中有DIRECT时可以直接发送
+	if err == nil && group != nil && !group.Direct {
+		err = errors.New("上游代理不支持转发udp")
+	}
+	if err != nil {
+		Log.Log.Println("udp报文已丢弃：" + target + "：" + err.Error())
+	}
+	i.lock.Lock()
+	i.routes[target] = err == nil
+	i.lock.Unlock()
+	return err == nil
+}
+
+// 处理目标地址返回的报文,加上头部后发给客户端
+func (i *socks5UdpRelay) handleResponse(packet []byte, from *net.UDPAddr) {
+	i.lock.Lock()
+	client := i.client
+	allowed := i.targets[from.String()]
+	i.lock.Unlock()
+	// 只转发客户端发送过数据的目标地址返回的报文
+	if client == nil || !allowed {
+		return
+	}
+	resolve := ResolveSocks5Udp(func(buff []byte) (int, error) {
+		header := AppendSocks5Addr([]byte{Rsv, Rsv, 0x00}, from.IP, from.Port)
+		n, err := i.conn.WriteToUDP(append(header, buff...), client)
+		if n > len(header) {
+			n -= len(header)
+		} else {
+			n = 0
+		}
+		return n, err
+	})
+	var err error
+	if i.proxy.server.OnSocks5UdpResponseEvent != nil {
+		_, err = i.proxy.server.OnSocks5UdpResponseEvent(packet, from.String(), resolve, i.proxy.conn)
+	} else {
+		_, err = resolve(packet)
+	}
+	if err != nil {
+		Log.Log.Println("返回udp数据错误：" + err.Error())
+	}
+}
+
+// 解析udp报文头部,格式为 2字节保留位、分片号、地址类型、地址、端口、数据
+func ParseSocks5UdpHeader(packet []byte) (byte, string, []byte, error) {
+	if len(packet) < 4 {
+		return 0, "", nil, errors.New("udp报文长度错误")
+	}
+	frag := packet[2]
+	var host string
+	var offset int
+	switch packet[3] {
+	case TargetIpv4:
+		offset = 4 + net.IPv4len
+		if len(packet) < offset+2 {
+			return 0, "", nil, errors.New("udp报文长度错误")
+		}
+		host = net.IP(packet[4:offset]).String()
+	case TargetIpv6:
+		offset = 4 + net.IPv6len
+		if len(packet) < offset+2 {
+			return 0, "", nil, errors.New("udp报文长度错误")
+		}
+		host = net.IP(packet[4:offset]).String()
+	case TargetDomain:
+		if len(packet) < 5 {
+			return 0, "", nil, errors.New("udp报文长度错误")
+		}
+		offset = 5 + int(packet[4])
+		if len(packet) < offset+2 {
+			return 0, "", nil, errors.New("udp报文长度错误")
+		}
+		host = string(packet[5:offset])
+	default:
+		return 0, "", nil, errors.New("不支持socks5地址")
+	}
+	port := binary.BigEndian.Uint16(packet[offset:])
+	return frag, net.JoinHostPort(host, strconv.Itoa(int(port))), packet[offset+2:], nil
+}
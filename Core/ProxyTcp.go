@@ -1,6 +1,7 @@
 package Core
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"io"
@@ -21,26 +22,19 @@ type ProxyTcp struct {
 type ResolveTcp func(buff []byte) (int, error)
 
 func (i *ProxyTcp) Handle() {
-	var tcpAddr *net.TCPAddr
-	var err error
-	tcpAddr, err = net.ResolveTCPAddr("tcp", i.server.to)
+	conn, err := i.server.DialContext(WithClientAddr(context.Background(), i.conn.RemoteAddr()), "tcp", i.server.to)
 	if err != nil {
-		Log.Log.Println("解析tcp代理目标地址错误：" + err.Error())
+		Log.Log.Println("连接tcp代理目标地址错误：" + err.Error())
 		return
 	}
-	conn, err := net.DialTCP("tcp", nil, tcpAddr)
 	defer func() {
 		_ = conn.Close()
 	}()
-	if err != nil {
-		Log.Log.Println("连接tcp代理目标地址错误：" + err.Error())
-		return
-	}
 	// 处理tls握手
-	host, port, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	host, port, _ := net.SplitHostPort(i.server.to)
 	certificate, err := Cache.GetCertificate(host, port)
 	if err != nil {
-		Log.Log.Println(conn.RemoteAddr().String() + "：获取证书失败：" + err.Error())
+		Log.Log.Println(i.server.to + "：获取证书失败：" + err.Error())
 		return
 	}
 	if _, ok := certificate.(tls.Certificate); !ok {
@@ -55,9 +49,6 @@ func (i *ProxyTcp) Handle() {
 	if err == nil {
 		i.ConnPeer.conn = sslConn
 	}
-	if !i.server.nagle {
-		_ = conn.SetNoDelay(false)
-	}
 	stop := make(chan error, 2)
 	go i.Transport(stop, i.ConnPeer.conn, conn, TcpClient)
 	go i.Transport(stop, conn, i.ConnPeer.conn, TcpServer)
@@ -101,7 +92,9 @@ func (i *ProxyTcp) Transport(out chan<- error, originConn net.Conn, targetConn n
 			}
 		}
 		if err != nil {
-			if err != io.EOF {
+			if err == io.EOF {
+				out <- err
+			} else {
 				out <- errors.New("tcp代理读取客户端数据错误-1")
 			}
 			break
@@ -0,0 +1,484 @@
+package Core
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// 域名解析,ProxyServer的所有出站连接都通过Resolver解析域名
+type Resolver interface {
+	LookupIP(ctx context.Context, host string) ([]net.IP, error)
+}
+
+// dns服务器的协议
+const (
+	DnsUdp   = "udp"
+	DnsTcp   = "tcp"
+	DnsTls   = "tls"
+	DnsHttps = "https"
+)
+
+var ErrDnsNotFound = errors.New("域名不存在")
+
+// 默认的域名解析,依次使用Hosts、缓存和Servers,没有设置Servers时使用系统解析
+type DnsResolver struct {
+	// 静态解析,域名对应一个或多个ip,优先于dns服务器
+	Hosts map[string][]string
+	// dns服务器,如 8.8.8.8、tcp://8.8.8.8:53、tls://1.1.1.1、https://1.1.1.1/dns-query,没有协议时按udp处理,依次尝试
+	Servers []string
+	// 每个dns服务器的查询超时时间
+	Timeout time.Duration
+	// 系统解析没有ttl,使用DefaultTtl作为缓存时间,dns服务器返回的ttl不超过MaxTtl
+	DefaultTtl time.Duration
+	MaxTtl     time.Duration
+	// 最多缓存的域名数量,超出时先清理过期的缓存
+	MaxEntries int
+	lock       *sync.Mutex
+	cache      map[string]*dnsCacheItem
+	client     *http.Client
+}
+
+// 域名不存在时也会按SOA记录的ttl缓存错误
+type dnsCacheItem struct {
+	ips    []net.IP
+	err    error
+	expire time.Time
+	// 查询完成后关闭,同一域名的并发请求等待同一次查询
+	done chan struct{}
+}
+
+func NewDnsResolver() *DnsResolver {
+	return &DnsResolver{
+		Hosts:      map[string][]string{},
+		Timeout:    time.Second * 5,
+		DefaultTtl: time.Minute * 5,
+		MaxTtl:     time.Hour,
+		MaxEntries: 10000,
+		lock:       &sync.Mutex{},
+		cache:      map[string]*dnsCacheItem{},
+		// DoH不使用环境变量中的代理,否则代理本身又通过该解析查询DoH服务器,服务器地址为域名时通过系统解析
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:               nil,
+				DialContext:         (&net.Dialer{}).DialContext,
+				ForceAttemptHTTP2:   true,
+				TLSHandshakeTimeout: time.Second * 5,
+				IdleConnTimeout:     time.Second * 90,
+			},
+		},
+	}
+}
+
+// 加载hosts格式的文件,每行为ip和一个或多个域名
+func (i *DnsResolver) LoadHosts(file string) error {
+	fd, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("读取hosts文件错误：%w", err)
+	}
+	defer func() {
+		_ = fd.Close()
+	}()
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		if net.ParseIP(fields[0]) == nil {
+			return errors.New("hosts文件中的ip错误：" + fields[0])
+		}
+		for _, name := range fields[1:] {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			i.Hosts[name] = append(i.Hosts[name], fields[0])
+		}
+	}
+	return scanner.Err()
+}
+
+func (i *DnsResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if items, ok := i.Hosts[host]; ok {
+		var ips []net.IP
+		for _, item := range items {
+			if ip := net.ParseIP(item); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+		return ips, nil
+	}
+	i.lock.Lock()
+	item, ok := i.cache[host]
+	if !ok || item.expired() {
+		item = &dnsCacheItem{done: make(chan struct{})}
+		i.cache[host] = item
+		i.evict()
+		// 查询不受单个请求取消的影响,每个dns服务器有各自的超时时间
+		go i.fill(context.WithoutCancel(ctx), host, item)
+	}
+	i.lock.Unlock()
+	select {
+	case <-item.done:
+		return item.ips, item.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("解析域名%s错误：%w", host, ctx.Err())
+	}
+}
+
+// 清空缓存
+func (i *DnsResolver) Clear() {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.cache = map[string]*dnsCacheItem{}
+}
+
+// 查询域名并写入缓存,没有ttl的错误不缓存
+func (i *DnsResolver) fill(ctx context.Context, host string, item *dnsCacheItem) {
+	ips, ttl, err := i.lookup(ctx, host)
+	if err != nil {
+		err = fmt.Errorf("解析域名%s错误：%w", host, err)
+	}
+	i.lock.Lock()
+	item.ips, item.err = ips, err
+	item.expire = time.Now().Add(ttl)
+	if ttl <= 0 && i.cache[host] == item {
+		delete(i.cache, host)
+	}
+	i.lock.Unlock()
+	close(item.done)
+}
+
+// 缓存超出MaxEntries时清理过期的域名,仍然超出时随机淘汰,调用时需要持有锁
+func (i *DnsResolver) evict() {
+	if i.MaxEntries <= 0 || len(i.cache) <= i.MaxEntries {
+		return
+	}
+	for host, item := range i.cache {
+		if item.expired() {
+			delete(i.cache, host)
+		}
+	}
+	for host, item := range i.cache {
+		if len(i.cache) <= i.MaxEntries {
+			return
+		}
+		if isClosed(item.done) {
+			delete(i.cache, host)
+		}
+	}
+}
+
+// 查询完成并且已经过期,调用时需要持有锁
+func (i *dnsCacheItem) expired() bool {
+	return isClosed(i.done) && !time.Now().Before(i.expire)
+}
+
+func isClosed(done chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+// 查询域名,返回ip和缓存时间,域名不存在时返回错误和SOA记录中的缓存时间
+func (i *DnsResolver) lookup(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	if len(i.Servers) == 0 {
+		ctx, cancel := context.WithTimeout(ctx, i.Timeout)
+		defer cancel()
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+		if err != nil {
+			return nil, 0, err
+		}
+		return ips, i.DefaultTtl, nil
+	}
+	var lastErr error
+	for _, server := range i.Servers {
+		serverCtx, cancel := context.WithTimeout(ctx, i.Timeout)
+		ips, ttl, err := i.query(serverCtx, server, host)
+		cancel()
+		if err == nil {
+			return ips, min(ttl, i.MaxTtl), nil
+		}
+		// 域名不存在是确定的结果,不再查询其他服务器
+		if errors.Is(err, ErrDnsNotFound) {
+			return nil, min(ttl, i.MaxTtl), fmt.Errorf("%s：%w", server, err)
+		}
+		lastErr = fmt.Errorf("%s：%w", server, err)
+	}
+	return nil, 0, lastErr
+}
+
+// 分别查询A和AAAA记录,缓存时间取最小的ttl,都没有记录时使用SOA记录的ttl
+func (i *DnsResolver) query(ctx context.Context, server string, host string) ([]net.IP, time.Duration, error) {
+	type result struct {
+		ips []net.IP
+		ttl time.Duration
+		err error
+	}
+	// A和AAAA并发查询,结果按A、AAAA的顺序合并
+	qtypes := []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	results := make([]result, len(qtypes))
+	wg := &sync.WaitGroup{}
+	for n, qtype := range qtypes {
+		wg.Add(1)
+		go func(n int, qtype dnsmessage.Type) {
+			defer wg.Done()
+			items, itemTtl, err := i.exchange(ctx, server, host, qtype)
+			results[n] = result{ips: items, ttl: itemTtl, err: err}
+		}(n, qtype)
+	}
+	wg.Wait()
+	var ips []net.IP
+	var lastErr error
+	ttl, negativeTtl := i.MaxTtl, i.MaxTtl
+	for _, item := range results {
+		if errors.Is(item.err, ErrDnsNotFound) {
+			return nil, item.ttl, item.err
+		}
+		if item.err != nil {
+			lastErr = item.err
+			continue
+		}
+		if len(item.ips) > 0 {
+			ips = append(ips, item.ips...)
+			ttl = min(ttl, item.ttl)
+		} else {
+			negativeTtl = min(negativeTtl, item.ttl)
+		}
+	}
+	if len(ips) == 0 {
+		if lastErr == nil {
+			return nil, negativeTtl, errors.New("没有解析结果")
+		}
+		return nil, 0, lastErr
+	}
+	return ips, ttl, nil
+}
+
+func (i *DnsResolver) exchange(ctx context.Context, server string, host string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	scheme, address, err := parseDnsServer(server)
+	if err != nil {
+		return nil, 0, err
+	}
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+	message := dnsmessage.Message{
+		Header:    dnsmessage.Header{RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	// DoH使用固定的id便于http缓存
+	if scheme != DnsHttps {
+		id := make([]byte, 2)
+		_, _ = rand.Read(id)
+		message.Header.ID = binary.BigEndian.Uint16(id)
+	}
+	query, err := message.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+	var answer []byte
+	switch scheme {
+	case DnsUdp:
+		answer, err = i.exchangeUdp(ctx, address, query, message.Header.ID)
+	case DnsTcp, DnsTls:
+		answer, err = i.exchangeStream(ctx, scheme, address, query)
+	case DnsHttps:
+		answer, err = i.exchangeHttps(ctx, address, query)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	var response dnsmessage.Message
+	err = response.Unpack(answer)
+	if err != nil {
+		return nil, 0, err
+	}
+	// udp应答被截断时使用tcp重新查询
+	if response.Header.Truncated && scheme == DnsUdp {
+		answer, err = i.exchangeStream(ctx, DnsTcp, address, query)
+		if err != nil {
+			return nil, 0, err
+		}
+		err = response.Unpack(answer)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	if response.Header.ID != message.Header.ID {
+		return nil, 0, errors.New("dns应答id不匹配")
+	}
+	if response.Header.RCode == dnsmessage.RCodeNameError {
+		return nil, negativeTtl(response), ErrDnsNotFound
+	}
+	if response.Header.RCode != dnsmessage.RCodeSuccess {
+		return nil, 0, errors.New("dns服务器返回" + response.Header.RCode.String())
+	}
+	var ips []net.IP
+	ttl := i.MaxTtl
+	for _, resource := range response.Answers {
+		switch body := resource.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(body.A[:]))
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(body.AAAA[:]))
+		default:
+			continue
+		}
+		ttl = min(ttl, time.Duration(resource.Header.TTL)*time.Second)
+	}
+	// 没有对应类型的记录
+	if len(ips) == 0 {
+		return nil, negativeTtl(response), nil
+	}
+	return ips, ttl, nil
+}
+
+// 否定应答的缓存时间,取SOA记录的ttl和minimum中较小的值,没有SOA记录时不缓存
+func negativeTtl(response dnsmessage.Message) time.Duration {
+	for _, resource := range response.Authorities {
+		if soa, ok := resource.Body.(*dnsmessage.SOAResource); ok {
+			return time.Duration(min(resource.Header.TTL, soa.MinTTL)) * time.Second
+		}
+	}
+	return 0
+}
+
+func (i *DnsResolver) exchangeUdp(ctx context.Context, address string, query []byte, id uint16) ([]byte, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "udp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	_, err = conn.Write(query)
+	if err != nil {
+		return nil, err
+	}
+	buff := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buff)
+		if err != nil {
+			return nil, err
+		}
+		// 忽略id不匹配的应答,继续等待
+		if n >= 2 && binary.BigEndian.Uint16(buff) == id {
+			return buff[:n], nil
+		}
+	}
+}
+
+// tcp和tls查询,报文前加两个字节的长度
+func (i *DnsResolver) exchangeStream(ctx context.Context, scheme string, address string, query []byte) ([]byte, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if scheme == DnsTls {
+		host, _, _ := net.SplitHostPort(address)
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+		err = tlsConn.HandshakeContext(ctx)
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	buff := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(buff, uint16(len(query)))
+	copy(buff[2:], query)
+	_, err = conn.Write(buff)
+	if err != nil {
+		return nil, err
+	}
+	length := make([]byte, 2)
+	_, err = io.ReadFull(conn, length)
+	if err != nil {
+		return nil, err
+	}
+	answer := make([]byte, binary.BigEndian.Uint16(length))
+	_, err = io.ReadFull(conn, answer)
+	if err != nil {
+		return nil, err
+	}
+	return answer, nil
+}
+
+// DNS over HTTPS,使用POST发送报文
+func (i *DnsResolver) exchangeHttps(ctx context.Context, address string, query []byte) ([]byte, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, address, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/dns-message")
+	request.Header.Set("Accept", "application/dns-message")
+	response, err := i.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = response.Body.Close()
+	}()
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.New("DoH服务器返回" + response.Status)
+	}
+	return io.ReadAll(io.LimitReader(response.Body, 65535))
+}
+
+// 解析dns服务器地址,返回协议和地址,DoH返回完整的url
+func parseDnsServer(server string) (string, string, error) {
+	if !strings.Contains(server, "://") {
+		server = DnsUdp + "://" + server
+	}
+	serverUrl, err := url.Parse(server)
+	if err != nil {
+		return "", "", fmt.Errorf("解析dns服务器地址错误：%w", err)
+	}
+	scheme := strings.ToLower(serverUrl.Scheme)
+	port := "53"
+	switch scheme {
+	case DnsUdp, DnsTcp:
+	case DnsTls:
+		port = "853"
+	case DnsHttps:
+		return scheme, serverUrl.String(), nil
+	default:
+		return "", "", errors.New("不支持的dns服务器协议：" + scheme)
+	}
+	if serverUrl.Port() != "" {
+		port = serverUrl.Port()
+	}
+	return scheme, net.JoinHostPort(serverUrl.Hostname(), port), nil
+}
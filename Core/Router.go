@@ -0,0 +1,201 @@
+package Core
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/k8scat/shermie-proxy/Log"
+)
+
+// 路由动作
+const (
+	// 直接连接目标服务器
+	RouteDirect = iota
+	// 通过上游代理连接
+	RouteProxy
+	// 拒绝连接
+	RouteBlock
+)
+
+// 路由规则,设置了的条件需要全部满足,同一条件中的多个值满足一个即可
+type Route struct {
+	Name string
+	// 域名后缀,example.com匹配example.com和所有子域名
+	DomainSuffix []string
+	// 通配符域名,使用path.Match匹配,如 *.corp.*
+	Domain []string
+	// 目标ip或CIDR,目标为域名时解析后匹配
+	Cidr []string
+	// 目标端口,支持范围,如 8000-9000
+	Port []string
+	// 客户端ip或CIDR
+	Client []string
+	Action int
+	// Action为RouteProxy时使用的上游代理,都为空时使用ProxyServer.Upstreams或Upstream
+	Upstream *UpstreamProxy
+	Group    *UpstreamGroup
+}
+
+var ErrRouteBlocked = errors.New("目标地址已被路由规则禁止")
+
+type clientAddrKey struct{}
+
+// 在context中记录客户端地址,用于按客户端路由
+func WithClientAddr(ctx context.Context, addr net.Addr) context.Context {
+	return context.WithValue(ctx, clientAddrKey{}, addr)
+}
+
+func ClientAddr(ctx context.Context) net.Addr {
+	addr, _ := ctx.Value(clientAddrKey{}).(net.Addr)
+	return addr
+}
+
+// 查找目标地址命中的路由,依次匹配Routes和Pac,都没有命中时返回nil
+func (i *ProxyServer) Route(client net.Addr, addr string) *Route {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	var clientIp net.IP
+	if tcpAddr, ok := client.(*net.TCPAddr); ok {
+		clientIp = tcpAddr.IP
+	}
+	// 目标ip只在规则需要时解析
+	var targetIp net.IP
+	resolved := false
+	lookup := func() net.IP {
+		if !resolved {
+			resolved = true
+			if ip, err := i.resolve(context.Background(), host); err == nil {
+				targetIp = net.ParseIP(ip)
+			}
+		}
+		return targetIp
+	}
+	for _, route := range i.Routes {
+		if route.match(host, port, clientIp, lookup) {
+			return route
+		}
+	}
+	if i.Pac != nil {
+		route, err := i.Pac.Route(host, port)
+		if err != nil {
+			Log.Log.Println("执行PAC脚本错误：" + err.Error())
+			return nil
+		}
+		return route
+	}
+	return nil
+}
+
+// 路由对应的上游代理组,返回nil时直接连接
+func (i *ProxyServer) egress(route *Route) (*UpstreamGroup, error) {
+	if route != nil {
+		switch route.Action {
+		case RouteDirect:
+			return nil, nil
+		case RouteBlock:
+			return nil, ErrRouteBlocked
+		}
+		if route.Group != nil {
+			return route.Group, nil
+		}
+		if route.Upstream != nil {
+			return route.Upstream.group(), nil
+		}
+	}
+	if i.Upstreams != nil {
+		return i.Upstreams, nil
+	}
+	if i.Upstream != nil {
+		return i.Upstream.group(), nil
+	}
+	return nil, nil
+}
+
+func (i *Route) match(host string, port string, client net.IP, lookup func() net.IP) bool {
+	if len(i.DomainSuffix) > 0 && !matchAny(i.DomainSuffix, func(suffix string) bool {
+		suffix = strings.ToLower(strings.Trim(suffix, "."))
+		return host == suffix || strings.HasSuffix(host, "."+suffix)
+	}) {
+		return false
+	}
+	if len(i.Domain) > 0 && !matchAny(i.Domain, func(pattern string) bool {
+		matched, _ := path.Match(strings.ToLower(pattern), host)
+		return matched
+	}) {
+		return false
+	}
+	if len(i.Port) > 0 && !matchAny(i.Port, func(item string) bool {
+		return matchPort(item, port)
+	}) {
+		return false
+	}
+	if len(i.Client) > 0 && (client == nil || !matchAny(i.Client, func(item string) bool {
+		return matchIp(item, client)
+	})) {
+		return false
+	}
+	if len(i.Cidr) > 0 {
+		ip := net.ParseIP(strings.Trim(host, "[]"))
+		if ip == nil {
+			ip = lookup()
+		}
+		if ip == nil || !matchAny(i.Cidr, func(item string) bool {
+			return matchIp(item, ip)
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchAny(items []string, fn func(item string) bool) bool {
+	for _, item := range items {
+		if fn(item) {
+			return true
+		}
+	}
+	return false
+}
+
+// 匹配ip或CIDR
+func matchIp(rule string, ip net.IP) bool {
+	if strings.Contains(rule, "/") {
+		_, network, err := net.ParseCIDR(rule)
+		if err != nil {
+			Log.Log.Println("解析路由规则错误：" + err.Error())
+			return false
+		}
+		return network.Contains(ip)
+	}
+	return net.ParseIP(rule).Equal(ip)
+}
+
+// 匹配端口或端口范围
+func matchPort(rule string, port string) bool {
+	value, err := strconv.Atoi(port)
+	if err != nil {
+		return false
+	}
+	low, high, isRange := strings.Cut(rule, "-")
+	min, err := strconv.Atoi(strings.TrimSpace(low))
+	if err != nil {
+		Log.Log.Println("解析路由端口错误：" + rule)
+		return false
+	}
+	max := min
+	if isRange {
+		max, err = strconv.Atoi(strings.TrimSpace(high))
+		if err != nil {
+			Log.Log.Println("解析路由端口错误：" + rule)
+			return false
+		}
+	}
+	return value >= min && value <= max
+}
@@ -0,0 +1,239 @@
+package Core
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/k8scat/shermie-proxy/Log"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+const (
+	// 无法识别的数据,直接转发
+	SniffOpaque = iota
+	SniffTls
+	SniffHttp
+	SniffHttp2
+)
+
+// tls握手记录类型
+const TlsHandshake = 0x16
+
+// http2明文连接的前导数据
+const http2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+var sniffMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+	http.MethodDelete, http.MethodOptions, http.MethodTrace,
+}
+
+// 探测连接上的协议,读取的数据保留在reader中,超过timeout没有数据时视为无法识别
+func Sniff(conn net.Conn, reader *bufio.Reader, timeout time.Duration) int {
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	defer func() {
+		_ = conn.SetReadDeadline(time.Time{})
+	}()
+	peek, err := reader.Peek(1)
+	if err != nil {
+		return SniffOpaque
+	}
+	// tls记录格式为 类型、2字节版本号,主版本号固定为3
+	if peek[0] == TlsHandshake {
+		peek, _ = reader.Peek(3)
+		if len(peek) == 3 && peek[1] == 0x03 {
+			return SniffTls
+		}
+		return SniffOpaque
+	}
+	// 最长的方法名加空格为8字节,数据不足时会等待到超时
+	peek, _ = reader.Peek(8)
+	if bytes.HasPrefix(peek, []byte("PRI ")) {
+		peek, _ = reader.Peek(len(http2Preface))
+		if string(peek) == http2Preface {
+			return SniffHttp2
+		}
+		return SniffOpaque
+	}
+	for _, method := range sniffMethods {
+		if bytes.HasPrefix(peek, []byte(method+" ")) {
+			return SniffHttp
+		}
+	}
+	return SniffOpaque
+}
+
+// 从tls握手数据中读取SNI,数据保留在reader中,读取失败返回空字符串
+func PeekServerName(conn net.Conn, reader *bufio.Reader, timeout time.Duration) string {
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	defer func() {
+		_ = conn.SetReadDeadline(time.Time{})
+	}()
+	header, err := reader.Peek(5)
+	if err != nil || header[0] != TlsHandshake {
+		return ""
+	}
+	// 只解析第一个tls记录,ClientHello超出缓冲区时按已读取的数据解析
+	length := int(binary.BigEndian.Uint16(header[3:5]))
+	if length > reader.Size()-5 {
+		length = reader.Size() - 5
+	}
+	record, _ := reader.Peek(5 + length)
+	if len(record) <= 5 {
+		return ""
+	}
+	return parseServerName(record[5:])
+}
+
+// 解析ClientHello中的server_name扩展
+func parseServerName(data []byte) string {
+	input := cryptobyte.String(data)
+	var messageType uint8
+	var hello cryptobyte.String
+	if !input.ReadUint8(&messageType) || messageType != 1 || !readPrefixed(&input, 3, &hello) {
+		return ""
+	}
+	var sessionId, cipherSuites, compression, extensions cryptobyte.String
+	if !hello.Skip(2+32) || !hello.ReadUint8LengthPrefixed(&sessionId) ||
+		!hello.ReadUint16LengthPrefixed(&cipherSuites) || !hello.ReadUint8LengthPrefixed(&compression) {
+		return ""
+	}
+	if !readPrefixed(&hello, 2, &extensions) {
+		return ""
+	}
+	for !extensions.Empty() {
+		var extension uint16
+		var body cryptobyte.String
+		if !extensions.ReadUint16(&extension) || !extensions.ReadUint16LengthPrefixed(&body) {
+			return ""
+		}
+		if extension != 0 {
+			continue
+		}
+		var names cryptobyte.String
+		if !body.ReadUint16LengthPrefixed(&names) {
+			return ""
+		}
+		for !names.Empty() {
+			var nameType uint8
+			var name cryptobyte.String
+			if !names.ReadUint8(&nameType) || !names.ReadUint16LengthPrefixed(&name) {
+				return ""
+			}
+			if nameType == 0 {
+				return strings.ToLower(string(name))
+			}
+		}
+	}
+	return ""
+}
+
+// 读取带长度前缀的数据,数据被截断时返回剩余部分
+func readPrefixed(input *cryptobyte.String, size int, out *cryptobyte.String) bool {
+	var prefix []byte
+	if !input.ReadBytes(&prefix, size) {
+		return false
+	}
+	length := 0
+	for _, b := range prefix {
+		length = length<<8 | int(b)
+	}
+	if length > len(*input) {
+		length = len(*input)
+	}
+	return input.ReadBytes((*[]byte)(out), length)
+}
+
+// 处理CONNECT和socks5隧道,intercept为false或者无法识别协议时调用relay直接转发
+func (i *ConnPeer) handleTunnel(host string, port string, intercept bool, relay func()) {
+	if !intercept {
+		relay()
+		return
+	}
+	// 后续读取需要经过reader,否则探测时缓冲的数据会丢失
+	i.conn = &bufferedConn{Conn: i.conn, reader: i.reader}
+	proxy := &ProxyHttp{
+		ConnPeer: *i,
+		port:     port,
+		tunnel:   host,
+		request:  &http.Request{Host: host},
+	}
+	switch Sniff(i.conn, i.reader, i.server.SniffTimeout) {
+	case SniffTls:
+		// 优先使用SNI判断是否解密,客户端使用ip建立隧道时SNI才是真实的域名
+		hostname, _, _ := net.SplitHostPort(host)
+		if serverName := PeekServerName(i.conn, i.reader, i.server.SniffTimeout); serverName != "" {
+			hostname = serverName
+			i.conn = &ServerNameConn{Conn: i.conn, ServerName: serverName}
+			proxy.conn = i.conn
+		}
+		// 证书页面总是需要解密
+		if !strings.EqualFold(hostname, SslFileHost) && !i.server.Mitm.ShouldIntercept(hostname) {
+			relay()
+			return
+		}
+		proxy.SslReceiveSend()
+	case SniffHttp:
+		if proxy.nextRequest() {
+			proxy.serveRequests()
+		}
+	case SniffHttp2:
+		proxy.serveHttp2()
+	default:
+		relay()
+	}
+}
+
+// CONNECT隧道中无法识别的数据,连接目标服务器后按tcp数据转发
+func (i *ProxyHttp) relayTunnel() {
+	target, err := i.server.DialContext(WithClientAddr(context.Background(), i.conn.RemoteAddr()), "tcp", i.request.Host)
+	if err != nil {
+		Log.Log.Println("连接目标服务器失败：" + i.request.Host + " " + err.Error())
+		return
+	}
+	defer func() {
+		_ = target.Close()
+	}()
+	tcp := &ProxyTcp{ConnPeer: i.ConnPeer}
+	stop := make(chan error, 2)
+	go tcp.Transport(stop, i.conn, target, TcpClient)
+	go tcp.Transport(stop, target, i.conn, TcpServer)
+	err = <-stop
+	Log.Log.Println("转发隧道数据错误：" + err.Error())
+}
+
+// 记录了SNI的连接,用于未解密直接转发的tls连接
+type ServerNameConn struct {
+	net.Conn
+	ServerName string
+}
+
+func (i *ServerNameConn) NetConn() net.Conn {
+	return i.Conn
+}
+
+// 获取客户端tls握手时发送的SNI,没有时返回空字符串
+func ServerName(conn net.Conn) string {
+	for conn != nil {
+		switch c := conn.(type) {
+		case *tls.Conn:
+			if serverName := c.ConnectionState().ServerName; serverName != "" {
+				return serverName
+			}
+			conn = c.NetConn()
+		case *ServerNameConn:
+			return c.ServerName
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return ""
+		}
+	}
+	return ""
+}
@@ -0,0 +1,219 @@
+package Core
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/k8scat/shermie-proxy/Log"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// socks5账号密码校验
+type Socks5Authenticator interface {
+	Authenticate(username string, password string) bool
+}
+
+// 固定的账号密码,key为账号,value为密码
+type StaticAuth map[string]string
+
+func (i StaticAuth) Authenticate(username string, password string) bool {
+	expect, ok := i[username]
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(expect), []byte(password)) == 1
+}
+
+// 自定义校验函数
+type Socks5AuthFunc func(username string, password string) bool
+
+func (i Socks5AuthFunc) Authenticate(username string, password string) bool {
+	return i(username, password)
+}
+
+// htpasswd文件,支持bcrypt、apr1、{SHA}和明文密码,文件修改后自动重新加载
+type HtpasswdAuth struct {
+	file    string
+	lock    *sync.RWMutex
+	users   map[string]string
+	modTime time.Time
+}
+
+func NewHtpasswdAuth(file string) (*HtpasswdAuth, error) {
+	auth := &HtpasswdAuth{
+		file: file,
+		lock: &sync.RWMutex{},
+	}
+	err := auth.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return auth, nil
+}
+
+// 重新加载htpasswd文件
+func (i *HtpasswdAuth) Reload() error {
+	stat, err := os.Stat(i.file)
+	if err != nil {
+		return fmt.Errorf("读取htpasswd文件失败：%w", err)
+	}
+	fd, err := os.Open(i.file)
+	if err != nil {
+		return fmt.Errorf("读取htpasswd文件失败：%w", err)
+	}
+	defer func() {
+		_ = fd.Close()
+	}()
+	users := map[string]string{}
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		separator := strings.Index(line, ":")
+		if separator <= 0 {
+			continue
+		}
+		users[line[:separator]] = line[separator+1:]
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("读取htpasswd文件失败：%w", err)
+	}
+	i.lock.Lock()
+	i.users = users
+	i.modTime = stat.ModTime()
+	i.lock.Unlock()
+	return nil
+}
+
+func (i *HtpasswdAuth) Authenticate(username string, password string) bool {
+	if stat, err := os.Stat(i.file); err == nil {
+		i.lock.RLock()
+		changed := !stat.ModTime().Equal(i.modTime)
+		i.lock.RUnlock()
+		if changed {
+			if err := i.Reload(); err != nil {
+				Log.Log.Println(err.Error())
+			}
+		}
+	}
+	i.lock.RLock()
+	hash, ok := i.users[username]
+	i.lock.RUnlock()
+	if !ok {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(hash, "$2y$"), strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "$apr1$"):
+		return subtle.ConstantTimeCompare([]byte(apr1(password, hash)), []byte(hash)) == 1
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		expect := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(expect), []byte(hash)) == 1
+	case strings.HasPrefix(hash, "$"), strings.HasPrefix(hash, "{"):
+		// 不支持的hash格式,如 $6$、{SSHA},不能当作明文比较
+		Log.Log.Println("不支持的htpasswd密码格式：" + username)
+		return false
+	default:
+		return subtle.ConstantTimeCompare([]byte(password), []byte(hash)) == 1
+	}
+}
+
+// apache的md5密码算法,hash格式为 $apr1$盐$密文
+func apr1(password string, hash string) string {
+	const magic = "$apr1$"
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	salt := strings.TrimPrefix(hash, magic)
+	if separator := strings.Index(salt, "$"); separator != -1 {
+		salt = salt[:separator]
+	}
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	ctx := md5.New()
+	ctx.Write([]byte(password + magic + salt))
+	alternate := md5.Sum([]byte(password + salt + password))
+	for n := len(password); n > 0; n -= 16 {
+		if n > 16 {
+			ctx.Write(alternate[:])
+		} else {
+			ctx.Write(alternate[:n])
+		}
+	}
+	for n := len(password); n > 0; n >>= 1 {
+		if n&1 == 1 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write([]byte{password[0]})
+		}
+	}
+	final := ctx.Sum(nil)
+	for n := 0; n < 1000; n++ {
+		round := md5.New()
+		if n&1 == 1 {
+			round.Write([]byte(password))
+		} else {
+			round.Write(final)
+		}
+		if n%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if n%7 != 0 {
+			round.Write([]byte(password))
+		}
+		if n&1 == 1 {
+			round.Write(final)
+		} else {
+			round.Write([]byte(password))
+		}
+		final = round.Sum(nil)
+	}
+	result := []byte(magic + salt + "$")
+	encode := func(a, b, c byte, n int) {
+		value := uint(a)<<16 | uint(b)<<8 | uint(c)
+		for ; n > 0; n-- {
+			result = append(result, itoa64[value&0x3f])
+			value >>= 6
+		}
+	}
+	encode(final[0], final[6], final[12], 4)
+	encode(final[1], final[7], final[13], 4)
+	encode(final[2], final[8], final[14], 4)
+	encode(final[3], final[9], final[15], 4)
+	encode(final[4], final[10], final[5], 4)
+	encode(0, 0, final[11], 2)
+	return string(result)
+}
+
+// 通过认证的连接,事件中可以通过Username获取账号
+type AuthConn struct {
+	net.Conn
+	Username string
+}
+
+// 获取连接认证时使用的账号,未认证返回空字符串
+func Username(conn net.Conn) string {
+	for conn != nil {
+		switch c := conn.(type) {
+		case *AuthConn:
+			return c.Username
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return ""
+		}
+	}
+	return ""
+}
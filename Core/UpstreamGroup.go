@@ -0,0 +1,246 @@
+package Core
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/k8scat/shermie-proxy/Log"
+)
+
+// 代理组选择上游代理的策略
+const (
+	// 轮询
+	StrategyRoundRobin = iota
+	// 活动连接数最少
+	StrategyLeastConn
+	// 连接耗时最短
+	StrategyLatency
+	// 同一客户端ip固定使用同一个代理
+	StrategySticky
+	// 按顺序使用第一个可用的代理
+	StrategyFailover
+)
+
+var UpstreamStrategies = map[string]int{
+	"round-robin": StrategyRoundRobin,
+	"least-conn":  StrategyLeastConn,
+	"latency":     StrategyLatency,
+	"sticky":      StrategySticky,
+	"failover":    StrategyFailover,
+}
+
+// 上游代理组,按策略选择可用的代理,连接失败时切换到其他代理
+type UpstreamGroup struct {
+	Members  []*UpstreamProxy
+	Strategy int
+	// 健康检查地址,为空时只根据连接失败被动剔除
+	ProbeUrl string
+	// 检查间隔,不大于0时使用30秒
+	ProbeInterval time.Duration
+	ProbeTimeout  time.Duration
+	// 连续连接失败的次数达到MaxFails后剔除,EjectTime后重新尝试
+	MaxFails  int
+	EjectTime time.Duration
+	// 所有代理都不可用时直接连接
+	Direct  bool
+	next    uint64
+	running int32
+	stop    chan struct{}
+}
+
+func NewUpstreamGroup(strategy int, members ...*UpstreamProxy) *UpstreamGroup {
+	return &UpstreamGroup{
+		Members:       members,
+		Strategy:      strategy,
+		ProbeInterval: time.Second * 30,
+		ProbeTimeout:  time.Second * 5,
+		MaxFails:      1,
+		EjectTime:     time.Second * 30,
+		stop:          make(chan struct{}),
+	}
+}
+
+// 解析逗号分隔的多个上游代理地址
+func ParseUpstreamGroup(raw string, strategy int) (*UpstreamGroup, error) {
+	var members []*UpstreamProxy
+	for _, item := range strings.Split(raw, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		upstream, err := ParseUpstreamProxy(item)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, upstream)
+	}
+	if len(members) == 0 {
+		return nil, errors.New("上游代理地址错误：" + raw)
+	}
+	return NewUpstreamGroup(strategy, members...), nil
+}
+
+// 按策略选择一个代理,tried中的代理不再选择,没有可用代理时在所有代理中选择,设置了Direct时返回nil表示直接连接
+func (i *UpstreamGroup) Select(client net.Addr, tried []*UpstreamProxy) *UpstreamProxy {
+	var candidates, fallback []*UpstreamProxy
+	for _, member := range i.Members {
+		if containsUpstream(tried, member) {
+			continue
+		}
+		fallback = append(fallback, member)
+		if member.available(i.MaxFails, i.EjectTime) {
+			candidates = append(candidates, member)
+		}
+	}
+	if len(candidates) == 0 && !i.Direct {
+		candidates = fallback
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	switch i.Strategy {
+	case StrategyLeastConn:
+		selected := candidates[0]
+		for _, member := range candidates[1:] {
+			if atomic.LoadInt64(&member.active) < atomic.LoadInt64(&selected.active) {
+				selected = member
+			}
+		}
+		return selected
+	case StrategyLatency:
+		// 没有测量过的代理耗时为0,会被优先选择以获得测量结果
+		selected, latency := candidates[0], candidates[0].getLatency()
+		for _, member := range candidates[1:] {
+			if value := member.getLatency(); value < latency {
+				selected, latency = member, value
+			}
+		}
+		return selected
+	case StrategyFailover:
+		return candidates[0]
+	case StrategySticky:
+		if tcpAddr, ok := client.(*net.TCPAddr); ok {
+			// 按客户端ip和代理地址计算权重,代理增减时只影响部分客户端
+			var selected *UpstreamProxy
+			var weight uint64
+			for _, member := range candidates {
+				hash := fnv.New64a()
+				_, _ = hash.Write([]byte(tcpAddr.IP.String() + "|" + member.String()))
+				if value := hash.Sum64(); selected == nil || value > weight {
+					selected, weight = member, value
+				}
+			}
+			return selected
+		}
+	}
+	return candidates[atomic.AddUint64(&i.next, 1)%uint64(len(candidates))]
+}
+
+// 选择代理并连接,无法连接代理服务器时切换到其他代理,dial的参数为nil时直接连接
+func (i *UpstreamGroup) Dial(ctx context.Context, client net.Addr, dial func(upstream *UpstreamProxy) (net.Conn, error)) (net.Conn, error) {
+	var tried []*UpstreamProxy
+	var lastErr error
+	for {
+		upstream := i.Select(client, tried)
+		if upstream == nil && i.Direct {
+			return dial(nil)
+		}
+		if upstream == nil {
+			if lastErr == nil {
+				lastErr = errors.New("上游代理组中没有代理")
+			}
+			return nil, lastErr
+		}
+		conn, err := dial(upstream)
+		var unreachable *UpstreamUnreachableError
+		if err == nil || ctx.Err() != nil || !errors.As(err, &unreachable) {
+			return conn, err
+		}
+		Log.Log.Println("上游代理不可用,切换到其他代理：" + err.Error())
+		tried = append(tried, upstream)
+		lastErr = err
+	}
+}
+
+// 定时检查所有代理,transport用于创建通过指定代理发送请求的Transport
+func (i *UpstreamGroup) Run(transport func(upstream *UpstreamProxy) *http.Transport) {
+	// 同一个代理组被多个服务使用时只检查一次
+	if i.ProbeUrl == "" || !atomic.CompareAndSwapInt32(&i.running, 0, 1) {
+		return
+	}
+	i.probe(transport)
+	interval := i.ProbeInterval
+	if interval <= 0 {
+		interval = time.Second * 30
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			i.probe(transport)
+		case <-i.stop:
+			return
+		}
+	}
+}
+
+func (i *UpstreamGroup) Close() {
+	select {
+	case <-i.stop:
+	default:
+		close(i.stop)
+	}
+}
+
+// 通过每个代理请求健康检查地址,状态码小于500时认为可用
+func (i *UpstreamGroup) probe(transport func(upstream *UpstreamProxy) *http.Transport) {
+	wg := &sync.WaitGroup{}
+	for _, member := range i.Members {
+		wg.Add(1)
+		go func(member *UpstreamProxy) {
+			defer wg.Done()
+			probeTransport := transport(member)
+			defer probeTransport.CloseIdleConnections()
+			client := &http.Client{Transport: probeTransport, Timeout: i.ProbeTimeout}
+			response, err := client.Get(i.ProbeUrl)
+			if err == nil {
+				_ = response.Body.Close()
+				if response.StatusCode >= http.StatusInternalServerError {
+					err = errors.New(response.Status)
+				}
+			}
+			member.lock.Lock()
+			defer member.lock.Unlock()
+			if err != nil {
+				if !member.down {
+					Log.Log.Println("上游代理健康检查失败：" + member.String() + "：" + err.Error())
+				}
+				member.down = true
+				return
+			}
+			if member.down || member.fails >= i.MaxFails {
+				Log.Log.Println("上游代理恢复可用：" + member.String())
+			}
+			member.down = false
+			member.fails = 0
+		}(member)
+	}
+	wg.Wait()
+}
+
+func containsUpstream(items []*UpstreamProxy, upstream *UpstreamProxy) bool {
+	for _, item := range items {
+		if item == upstream {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,206 @@
+package Core
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// 上游连接池,按协议、目标主机、上级代理、出口网卡区分,每个分组复用同一个http.Transport
+type UpstreamPool struct {
+	// 每个目标主机最多保留的空闲连接数
+	MaxIdleConnsPerHost int
+	// 空闲连接超时时间,超过该时间未使用的分组会被整体回收
+	IdleConnTimeout time.Duration
+	lock            *sync.Mutex
+	transports      map[string]*pooledTransport
+	stop            chan struct{}
+	dials           int64
+	dialErrors      int64
+	openConns       int64
+	requests        int64
+	reused          int64
+	evicted         int64
+}
+
+type pooledTransport struct {
+	transport *http.Transport
+	lastUsed  time.Time
+}
+
+// 连接池统计数据
+type PoolStats struct {
+	Transports int
+	OpenConns  int64
+	Dials      int64
+	DialErrors int64
+	Requests   int64
+	Reused     int64
+	Evicted    int64
+}
+
+// 统计连接的关闭
+type pooledConn struct {
+	net.Conn
+	pool   *UpstreamPool
+	closed int32
+}
+
+func (i *pooledConn) Close() error {
+	if atomic.CompareAndSwapInt32(&i.closed, 0, 1) {
+		atomic.AddInt64(&i.pool.openConns, -1)
+	}
+	return i.Conn.Close()
+}
+
+func NewUpstreamPool() *UpstreamPool {
+	return &UpstreamPool{
+		MaxIdleConnsPerHost: 8,
+		IdleConnTimeout:     time.Second * 90,
+		lock:                &sync.Mutex{},
+		transports:          map[string]*pooledTransport{},
+		stop:                make(chan struct{}),
+	}
+}
+
+// 生成连接池分组的key
+func PoolKey(scheme string, host string, proxy string, network string) string {
+	return scheme + "://" + host + "|" + proxy + "|" + network
+}
+
+// 获取分组对应的Transport,不存在时使用create创建
+func (i *UpstreamPool) Transport(key string, create func() *http.Transport) *http.Transport {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if item, exist := i.transports[key]; exist {
+		item.lastUsed = time.Now()
+		return item.transport
+	}
+	transport := create()
+	transport.DisableKeepAlives = false
+	transport.MaxIdleConnsPerHost = i.MaxIdleConnsPerHost
+	transport.IdleConnTimeout = i.IdleConnTimeout
+	transport.DialContext = i.wrapDial(transport.DialContext)
+	i.transports[key] = &pooledTransport{
+		transport: transport,
+		lastUsed:  time.Now(),
+	}
+	return transport
+}
+
+// 通过连接池发送请求
+func (i *UpstreamPool) RoundTrip(key string, create func() *http.Transport, request *http.Request) (*http.Response, error) {
+	transport := i.Transport(key, create)
+	atomic.AddInt64(&i.requests, 1)
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				atomic.AddInt64(&i.reused, 1)
+			}
+		},
+	}
+	response, err := transport.RoundTrip(request.WithContext(httptrace.WithClientTrace(request.Context(), trace)))
+	// 连接失败时该分组的空闲连接可能已经失效,全部剔除,请求取消等请求本身的错误不影响其他连接
+	if err != nil && request.Context().Err() == nil && isConnError(err) {
+		transport.CloseIdleConnections()
+		atomic.AddInt64(&i.evicted, 1)
+	}
+	return response, err
+}
+
+func (i *UpstreamPool) wrapDial(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		atomic.AddInt64(&i.dials, 1)
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			atomic.AddInt64(&i.dialErrors, 1)
+			return nil, err
+		}
+		atomic.AddInt64(&i.openConns, 1)
+		return &pooledConn{Conn: conn, pool: i}, nil
+	}
+}
+
+// 定时回收长时间未使用的分组,IdleConnTimeout不大于0时不回收
+func (i *UpstreamPool) Run() {
+	if i.IdleConnTimeout <= 0 {
+		return
+	}
+	ticker := time.NewTicker(max(i.IdleConnTimeout/2, time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-i.stop:
+			return
+		case <-ticker.C:
+			i.evict(time.Now().Add(-i.IdleConnTimeout))
+		}
+	}
+}
+
+func (i *UpstreamPool) evict(before time.Time) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	for key, item := range i.transports {
+		if item.lastUsed.Before(before) {
+			item.transport.CloseIdleConnections()
+			delete(i.transports, key)
+			atomic.AddInt64(&i.evicted, 1)
+		}
+	}
+}
+
+// 连接或读写连接时的错误
+func isConnError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// 关闭连接池
+func (i *UpstreamPool) Close() {
+	select {
+	case <-i.stop:
+	default:
+		close(i.stop)
+	}
+	i.evict(time.Now().Add(time.Hour))
+}
+
+func (i *UpstreamPool) Stats() PoolStats {
+	i.lock.Lock()
+	transports := len(i.transports)
+	i.lock.Unlock()
+	return PoolStats{
+		Transports: transports,
+		OpenConns:  atomic.LoadInt64(&i.openConns),
+		Dials:      atomic.LoadInt64(&i.dials),
+		DialErrors: atomic.LoadInt64(&i.dialErrors),
+		Requests:   atomic.LoadInt64(&i.requests),
+		Reused:     atomic.LoadInt64(&i.reused),
+		Evicted:    atomic.LoadInt64(&i.evicted),
+	}
+}
+
+// 默认的上游Transport配置
+func newUpstreamTransport(dial func(ctx context.Context, network, addr string) (net.Conn, error)) *http.Transport {
+	return &http.Transport{
+		TLSHandshakeTimeout:   15 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		DialContext:           dial,
+		TLSClientConfig:       &tls.Config{InsecureSkipVerify: true},
+		// 由Codec统一处理内容编码,不使用Transport自带的gzip解压
+		DisableCompression: true,
+		ForceAttemptHTTP2:  true,
+	}
+}
@@ -0,0 +1,265 @@
+package Core
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// 上游代理的协议
+const (
+	UpstreamHttp    = "http"
+	UpstreamHttps   = "https"
+	UpstreamSocks5  = "socks5"
+	UpstreamSocks5h = "socks5h"
+)
+
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// 上游代理,http和https使用CONNECT建立隧道,socks5在本地解析域名,socks5h由代理解析域名
+type UpstreamProxy struct {
+	URL *url.URL
+	// 以下为代理组选择代理时使用的状态
+	lock    sync.Mutex
+	active  int64
+	fails   int
+	failAt  time.Time
+	down    bool
+	latency time.Duration
+	once    sync.Once
+	single  *UpstreamGroup
+}
+
+// 无法连接上游代理服务器,代理组会切换到其他代理重试
+type UpstreamUnreachableError struct {
+	Proxy string
+	Err   error
+}
+
+func (i *UpstreamUnreachableError) Error() string {
+	return "连接上游代理" + i.Proxy + "失败：" + i.Err.Error()
+}
+
+func (i *UpstreamUnreachableError) Unwrap() error {
+	return i.Err
+}
+
+// 解析上游代理地址,没有协议时按http处理
+func ParseUpstreamProxy(raw string) (*UpstreamProxy, error) {
+	if !strings.Contains(raw, "://") {
+		raw = UpstreamHttp + "://" + raw
+	}
+	proxyUrl, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("解析上游代理地址错误：%w", err)
+	}
+	proxyUrl.Scheme = strings.ToLower(proxyUrl.Scheme)
+	switch proxyUrl.Scheme {
+	case UpstreamHttp, UpstreamHttps, UpstreamSocks5, UpstreamSocks5h:
+	default:
+		return nil, errors.New("不支持的上游代理协议：" + proxyUrl.Scheme)
+	}
+	if proxyUrl.Hostname() == "" {
+		return nil, errors.New("上游代理地址错误：" + raw)
+	}
+	if proxyUrl.Port() == "" {
+		port := "1080"
+		if proxyUrl.Scheme == UpstreamHttp {
+			port = "80"
+		} else if proxyUrl.Scheme == UpstreamHttps {
+			port = "443"
+		}
+		proxyUrl.Host = net.JoinHostPort(proxyUrl.Hostname(), port)
+	}
+	return &UpstreamProxy{URL: proxyUrl}, nil
+}
+
+// 是否需要在本地解析目标域名
+func (i *UpstreamProxy) ResolveLocally() bool {
+	return i.URL.Scheme == UpstreamSocks5
+}
+
+// 日志和连接池分组使用的地址,不包含密码
+func (i *UpstreamProxy) String() string {
+	return i.URL.Scheme + "://" + i.URL.Host
+}
+
+// 通过上游代理连接addr,forward用于连接代理服务器
+func (i *UpstreamProxy) Dial(ctx context.Context, forward DialFunc, network, addr string) (net.Conn, error) {
+	switch i.URL.Scheme {
+	case UpstreamSocks5, UpstreamSocks5h:
+		var auth *proxy.Auth
+		if i.URL.User != nil {
+			password, _ := i.URL.User.Password()
+			auth = &proxy.Auth{User: i.URL.User.Username(), Password: password}
+		}
+		dialer, err := proxy.SOCKS5("tcp", i.URL.Host, auth, forwardDialer(func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return i.DialProxy(ctx, forward)
+		}))
+		if err != nil {
+			return nil, err
+		}
+		conn, err := dialer.(proxy.ContextDialer).DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, fmt.Errorf("通过上游代理%s连接失败：%w", i, err)
+		}
+		return i.track(conn), nil
+	}
+	conn, err := i.DialProxy(ctx, forward)
+	if err != nil {
+		return nil, err
+	}
+	conn, err = i.connect(ctx, conn, addr)
+	if err != nil {
+		return nil, fmt.Errorf("通过上游代理%s连接失败：%w", i, err)
+	}
+	return i.track(conn), nil
+}
+
+// 连接上游代理服务器,记录连接耗时和失败次数
+func (i *UpstreamProxy) DialProxy(ctx context.Context, forward DialFunc) (net.Conn, error) {
+	start := time.Now()
+	conn, err := forward(ctx, "tcp", i.URL.Host)
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if err != nil {
+		i.fails++
+		i.failAt = time.Now()
+		return nil, &UpstreamUnreachableError{Proxy: i.String(), Err: err}
+	}
+	i.fails = 0
+	// 连接耗时取加权平均,避免单次波动影响选择
+	if elapsed := time.Since(start); i.latency == 0 {
+		i.latency = elapsed
+	} else {
+		i.latency = (i.latency*4 + elapsed) / 5
+	}
+	return conn, nil
+}
+
+// 统计通过该代理的活动连接数
+func (i *UpstreamProxy) track(conn net.Conn) net.Conn {
+	atomic.AddInt64(&i.active, 1)
+	return &upstreamConn{Conn: conn, upstream: i}
+}
+
+// 是否可以使用,被动剔除的代理在ejectTime后自动恢复,健康检查失败的代理在检查成功后恢复
+func (i *UpstreamProxy) available(maxFails int, ejectTime time.Duration) bool {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if i.down {
+		return false
+	}
+	return i.fails < maxFails || time.Since(i.failAt) >= ejectTime
+}
+
+func (i *UpstreamProxy) getLatency() time.Duration {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	return i.latency
+}
+
+// 单个上游代理按只有一个成员的代理组处理
+func (i *UpstreamProxy) group() *UpstreamGroup {
+	i.once.Do(func() {
+		i.single = NewUpstreamGroup(StrategyRoundRobin, i)
+	})
+	return i.single
+}
+
+// 发送CONNECT请求建立隧道
+func (i *UpstreamProxy) connect(ctx context.Context, conn net.Conn, addr string) (net.Conn, error) {
+	deadline := time.Now().Add(time.Second * 30)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	_ = conn.SetDeadline(deadline)
+	defer func() {
+		_ = conn.SetDeadline(time.Time{})
+	}()
+	if i.URL.Scheme == UpstreamHttps {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: i.URL.Hostname()})
+		err := tlsConn.HandshakeContext(ctx)
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if authorization := i.Authorization(); authorization != "" {
+		request.Header.Set("Proxy-Authorization", authorization)
+	}
+	err := request.Write(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, errors.New("上游代理返回" + response.Status)
+	}
+	// 代理可能在应答后立即转发了目标服务器的数据
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// http代理的认证头
+func (i *UpstreamProxy) Authorization() string {
+	if i.URL.User == nil {
+		return ""
+	}
+	password, _ := i.URL.User.Password()
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(i.URL.User.Username()+":"+password))
+}
+
+// 将DialFunc转换为socks5拨号使用的Dialer
+type forwardDialer DialFunc
+
+func (i forwardDialer) Dial(network, addr string) (net.Conn, error) {
+	return i(context.Background(), network, addr)
+}
+
+func (i forwardDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return i(ctx, network, addr)
+}
+
+// 关闭时减少代理的活动连接数
+type upstreamConn struct {
+	net.Conn
+	upstream *UpstreamProxy
+	closed   int32
+}
+
+func (i *upstreamConn) Close() error {
+	if atomic.CompareAndSwapInt32(&i.closed, 0, 1) {
+		atomic.AddInt64(&i.upstream.active, -1)
+	}
+	return i.Conn.Close()
+}
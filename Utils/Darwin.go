@@ -0,0 +1,21 @@
+//go:build darwin
+// +build darwin
+
+package Utils
+
+import "errors"
+
+func InstallCert(certName string) error {
+
+	return errors.New("不支持macOS系统")
+}
+
+func UninstallCert() error {
+
+	return errors.New("不支持macOS系统")
+}
+
+func SetSystemProxy(proxy string) error {
+
+	return errors.New("不支持macOS系统")
+}
@@ -3,14 +3,478 @@
 
 package Utils
 
-import "errors"
+import (
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
 
+	"github.com/k8scat/shermie-proxy/Log"
+)
+
+// 发行版证书目录和更新命令
+type trustStore struct {
+	dir     string
+	ext     string
+	command []string
+}
+
+var trustStores = []trustStore{
+	// Debian、Ubuntu
+	{dir: "/usr/local/share/ca-certificates", ext: ".crt", command: []string{"update-ca-certificates"}},
+	// RHEL、Fedora、CentOS
+	{dir: "/etc/pki/ca-trust/source/anchors", ext: ".pem", command: []string{"update-ca-trust", "extract"}},
+	// Arch
+	{dir: "/etc/ca-certificates/trust-source/anchors", ext: ".crt", command: []string{"trust", "extract-compat"}},
+	// openSUSE
+	{dir: "/etc/pki/trust/anchors", ext: ".pem", command: []string{"update-ca-certificates"}},
+}
+
+// 安装根证书到系统证书目录和用户的NSS数据库(Firefox、Chrome),两者分别安装,错误合并返回
 func InstallCert(certName string) error {
+	cert, err := os.ReadFile(certName)
+	if err != nil {
+		return fmt.Errorf("读取证书文件错误：%w", err)
+	}
+	// 系统证书目录只接受pem格式
+	if block, _ := pem.Decode(cert); block == nil {
+		cert = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})
+	}
+	// 系统证书目录需要root权限,失败时仍然安装到不需要root权限的NSS数据库
+	return errors.Join(installSystemCert(cert), installNssCert(cert))
+}
+
+func installSystemCert(cert []byte) error {
+	store, ok := findTrustStore()
+	if !ok {
+		return errors.New("未找到系统证书目录")
+	}
+	file := filepath.Join(SystemRoot, store.dir, CertName+store.ext)
+	err := os.WriteFile(file, cert, 0644)
+	if err != nil {
+		return fmt.Errorf("写入系统证书错误：%w", err)
+	}
+	err = runCommand(store.command...)
+	if err != nil {
+		return fmt.Errorf("更新系统证书错误：%w", err)
+	}
+	return nil
+}
+
+// 安装到每个NSS数据库,一个数据库失败时继续安装其他数据库
+func installNssCert(cert []byte) error {
+	databases := nssDatabases()
+	if len(databases) == 0 {
+		return nil
+	}
+	file, err := os.CreateTemp("", CertName+"-*.pem")
+	if err != nil {
+		return fmt.Errorf("写入NSS证书错误：%w", err)
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(cert)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("写入NSS证书错误：%w", err)
+	}
+	var errs []error
+	for _, database := range databases {
+		// 先删除同名证书,保证证书轮换后可以覆盖
+		if runCommand("certutil", "-L", "-d", database, "-n", CertName) == nil {
+			_ = runCommand("certutil", "-D", "-d", database, "-n", CertName)
+		}
+		err = runCommand("certutil", "-A", "-d", database, "-t", "C,,", "-n", CertName, "-i", file.Name())
+		if err != nil {
+			errs = append(errs, fmt.Errorf("安装NSS证书错误：%w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// 从系统证书目录和NSS数据库中删除根证书
+func UninstallCert() error {
+	for _, store := range trustStores {
+		file := filepath.Join(SystemRoot, store.dir, CertName+store.ext)
+		if !FileExist(file) {
+			continue
+		}
+		err := os.Remove(file)
+		if err != nil {
+			return fmt.Errorf("删除系统证书错误：%w", err)
+		}
+		err = runCommand(store.command...)
+		if err != nil {
+			return fmt.Errorf("更新系统证书错误：%w", err)
+		}
+	}
+	for _, database := range nssDatabases() {
+		if runCommand("certutil", "-L", "-d", database, "-n", CertName) != nil {
+			continue
+		}
+		err := runCommand("certutil", "-D", "-d", database, "-n", CertName)
+		if err != nil {
+			return fmt.Errorf("删除NSS证书错误：%w", err)
+		}
+	}
+	return nil
+}
+
+// 设置前的系统代理,恢复时使用
+type proxyBackup struct {
+	// gsettings的原始值,key为schema和key名称
+	Gsettings map[string]string `json:"gsettings"`
+	// kioslaverc的原始内容,文件不存在时为nil
+	Kioslaverc *string `json:"kioslaverc"`
+}
 
-	return errors.New("不支持Linux系统")
+var gsettingsKeys = [][2]string{
+	{"org.gnome.system.proxy", "mode"},
+	{"org.gnome.system.proxy", "ignore-hosts"},
+	{"org.gnome.system.proxy.http", "host"},
+	{"org.gnome.system.proxy.http", "port"},
+	{"org.gnome.system.proxy.https", "host"},
+	{"org.gnome.system.proxy.https", "port"},
 }
 
+// 不使用代理的地址
+var noProxy = []string{"localhost", "127.0.0.0/8", "::1"}
+
+// 本进程是否修改过系统代理,没有修改过时不恢复,避免删除用户自己的设置
+var proxyApplied bool
+
+// 设置系统代理,写入环境变量文件、GNOME和KDE的代理设置,proxy为空时恢复设置前的值,本进程没有设置过时不做修改
 func SetSystemProxy(proxy string) error {
+	if proxy == "" {
+		if !proxyApplied {
+			return nil
+		}
+		err := restoreSystemProxy()
+		if err == nil {
+			proxyApplied = false
+		}
+		return err
+	}
+	host, port, err := net.SplitHostPort(proxy)
+	if err != nil {
+		return fmt.Errorf("代理地址错误：%w", err)
+	}
+	err = backupSystemProxy()
+	if err != nil {
+		return fmt.Errorf("备份系统代理错误：%w", err)
+	}
+	proxyApplied = true
+	err = writeProxyEnv("http://" + proxy)
+	if err != nil {
+		return fmt.Errorf("写入代理环境变量错误：%w", err)
+	}
+	if gnomeAvailable() {
+		ignoreHosts := "['" + strings.Join(noProxy, "', '") + "']"
+		for _, args := range [][]string{
+			{"org.gnome.system.proxy", "mode", "manual"},
+			{"org.gnome.system.proxy", "ignore-hosts", ignoreHosts},
+			{"org.gnome.system.proxy.http", "host", host},
+			{"org.gnome.system.proxy.http", "port", port},
+			{"org.gnome.system.proxy.https", "host", host},
+			{"org.gnome.system.proxy.https", "port", port},
+		} {
+			err = runCommand(append([]string{"gsettings", "set"}, args...)...)
+			if err != nil {
+				return fmt.Errorf("设置GNOME代理错误：%w", err)
+			}
+		}
+	}
+	if kdeAvailable() {
+		content, _ := os.ReadFile(kioslavercFile())
+		content = setIniValues(content, "Proxy Settings", [][2]string{
+			{"ProxyType", "1"},
+			{"httpProxy", "http://" + host + " " + port},
+			{"httpsProxy", "http://" + host + " " + port},
+			{"NoProxyFor", strings.Join(noProxy, ",")},
+		})
+		err = writeKioslaverc(content)
+		if err != nil {
+			return fmt.Errorf("设置KDE代理错误：%w", err)
+		}
+	}
+	return nil
+}
+
+// 恢复设置前的系统代理,没有备份时只删除环境变量文件
+func restoreSystemProxy() error {
+	for _, file := range proxyEnvFiles() {
+		err := os.Remove(file)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("删除代理环境变量错误：%w", err)
+		}
+	}
+	content, err := os.ReadFile(proxyBackupFile())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("读取系统代理备份错误：%w", err)
+	}
+	backup := proxyBackup{}
+	err = json.Unmarshal(content, &backup)
+	if err != nil {
+		return fmt.Errorf("解析系统代理备份错误：%w", err)
+	}
+	for _, key := range gsettingsKeys {
+		value, ok := backup.Gsettings[key[0]+" "+key[1]]
+		if !ok {
+			continue
+		}
+		err = runCommand("gsettings", "set", key[0], key[1], value)
+		if err != nil {
+			return fmt.Errorf("恢复GNOME代理错误：%w", err)
+		}
+	}
+	if backup.Kioslaverc != nil {
+		err = writeKioslaverc([]byte(*backup.Kioslaverc))
+	} else if FileExist(kioslavercFile()) {
+		err = os.Remove(kioslavercFile())
+	}
+	if err != nil {
+		return fmt.Errorf("恢复KDE代理错误：%w", err)
+	}
+	return os.Remove(proxyBackupFile())
+}
+
+// 备份当前的系统代理,已有备份时不覆盖,保证多次设置后可以恢复到最初的值
+func backupSystemProxy() error {
+	file := proxyBackupFile()
+	if FileExist(file) {
+		return nil
+	}
+	backup := proxyBackup{Gsettings: map[string]string{}}
+	if gnomeAvailable() {
+		for _, key := range gsettingsKeys {
+			value, err := exec.Command("gsettings", "get", key[0], key[1]).Output()
+			if err != nil {
+				return fmt.Errorf("读取GNOME代理错误：%w", err)
+			}
+			backup.Gsettings[key[0]+" "+key[1]] = strings.TrimSpace(string(value))
+		}
+	}
+	if content, err := os.ReadFile(kioslavercFile()); err == nil {
+		kioslaverc := string(content)
+		backup.Kioslaverc = &kioslaverc
+	}
+	content, err := json.MarshalIndent(backup, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(file), 0700)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, content, 0600)
+}
+
+// 优先写入/etc/profile.d,没有权限时写入用户的environment.d
+func writeProxyEnv(proxy string) error {
+	var profile, environment strings.Builder
+	profile.WriteString("# shermie-proxy\n")
+	for _, name := range []string{"http_proxy", "https_proxy", "HTTP_PROXY", "HTTPS_PROXY"} {
+		profile.WriteString("export " + name + "=" + proxy + "\n")
+		environment.WriteString(name + "=" + proxy + "\n")
+	}
+	for _, name := range []string{"no_proxy", "NO_PROXY"} {
+		profile.WriteString("export " + name + "=" + strings.Join(noProxy, ",") + "\n")
+		environment.WriteString(name + "=" + strings.Join(noProxy, ",") + "\n")
+	}
+	files := proxyEnvFiles()
+	if FileExist(filepath.Dir(files[0])) {
+		err := os.WriteFile(files[0], []byte(profile.String()), 0644)
+		if err == nil || !os.IsPermission(err) {
+			return err
+		}
+	}
+	if files[1] == "" {
+		return errors.New("未找到用户目录")
+	}
+	err := os.MkdirAll(filepath.Dir(files[1]), 0755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(files[1], []byte(environment.String()), 0644)
+}
+
+// profile.d和environment.d中的代理环境变量文件
+func proxyEnvFiles() []string {
+	files := []string{filepath.Join(SystemRoot, "/etc/profile.d", CertName+".sh"), ""}
+	if home := homeDir(); home != "" {
+		files[1] = filepath.Join(home, ".config/environment.d", CertName+".conf")
+	}
+	return files
+}
+
+func proxyBackupFile() string {
+	return filepath.Join(homeDir(), ".config", CertName, "proxy-backup.json")
+}
+
+func kioslavercFile() string {
+	return filepath.Join(homeDir(), ".config/kioslaverc")
+}
+
+// 写入kioslaverc并通知KDE重新读取代理设置
+func writeKioslaverc(content []byte) error {
+	err := os.MkdirAll(filepath.Dir(kioslavercFile()), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(kioslavercFile(), content, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := exec.LookPath("dbus-send"); err == nil || DryRun {
+		_ = runCommand("dbus-send", "--type=signal", "/KIO/Scheduler", "org.kde.KIO.Scheduler.reparseSlaveConfiguration", "string:")
+	}
+	return nil
+}
+
+// gsettings中有GNOME代理的schema时才设置
+func gnomeAvailable() bool {
+	return exec.Command("gsettings", "get", "org.gnome.system.proxy", "mode").Run() == nil
+}
+
+func kdeAvailable() bool {
+	return FileExist(kioslavercFile()) || strings.Contains(os.Getenv("XDG_CURRENT_DESKTOP"), "KDE")
+}
+
+// 修改ini文件中指定分组的值,分组或key不存在时追加
+func setIniValues(content []byte, section string, values [][2]string) []byte {
+	lines := strings.Split(strings.TrimRight(string(content), "\n"), "\n")
+	if len(content) == 0 {
+		lines = nil
+	}
+	written := map[string]bool{}
+	var result []string
+	inSection, found := false, false
+	// 在分组结束前追加未写入的key
+	flush := func() {
+		blank := 0
+		for len(result) > 0 && strings.TrimSpace(result[len(result)-1]) == "" {
+			result = result[:len(result)-1]
+			blank++
+		}
+		for _, value := range values {
+			if !written[value[0]] {
+				result = append(result, value[0]+"="+value[1])
+				written[value[0]] = true
+			}
+		}
+		for ; blank > 0; blank-- {
+			result = append(result, "")
+		}
+	}
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+			if inSection {
+				flush()
+			}
+			inSection = trimmed == "["+section+"]"
+			found = found || inSection
+			result = append(result, line)
+			continue
+		}
+		if inSection {
+			key := strings.TrimSpace(strings.SplitN(trimmed, "=", 2)[0])
+			replaced := false
+			for _, value := range values {
+				if value[0] == key {
+					result = append(result, value[0]+"="+value[1])
+					written[key] = true
+					replaced = true
+				}
+			}
+			if replaced {
+				continue
+			}
+		}
+		result = append(result, line)
+	}
+	if inSection {
+		flush()
+	}
+	if !found {
+		if len(result) > 0 {
+			result = append(result, "")
+		}
+		result = append(result, "["+section+"]")
+		flush()
+	}
+	return []byte(strings.Join(result, "\n") + "\n")
+}
+
+// 按目录是否存在判断发行版
+func findTrustStore() (trustStore, bool) {
+	for _, store := range trustStores {
+		if FileExist(filepath.Join(SystemRoot, store.dir)) {
+			return store, true
+		}
+	}
+	return trustStore{}, false
+}
+
+// 当前用户的主目录,使用sudo运行时返回原用户的目录
+func homeDir() string {
+	home, _ := os.UserHomeDir()
+	if sudoUser := os.Getenv("SUDO_USER"); sudoUser != "" {
+		if u, err := user.Lookup(sudoUser); err == nil {
+			home = u.HomeDir
+		}
+	}
+	if home == "" {
+		return ""
+	}
+	return filepath.Join(SystemRoot, home)
+}
+
+// 当前用户的NSS数据库
+func nssDatabases() []string {
+	home := homeDir()
+	if home == "" {
+		return nil
+	}
+	dirs := []string{filepath.Join(home, ".pki/nssdb")}
+	for _, pattern := range []string{
+		".mozilla/firefox/*",
+		"snap/firefox/common/.mozilla/firefox/*",
+		"snap/chromium/current/.pki/nssdb",
+	} {
+		matches, _ := filepath.Glob(filepath.Join(home, pattern))
+		dirs = append(dirs, matches...)
+	}
+	var databases []string
+	for _, dir := range dirs {
+		if FileExist(filepath.Join(dir, "cert9.db")) {
+			databases = append(databases, "sql:"+dir)
+		} else if FileExist(filepath.Join(dir, "cert8.db")) {
+			databases = append(databases, "dbm:"+dir)
+		}
+	}
+	return databases
+}
 
-	return errors.New("不支持Linux系统")
+// 执行命令,DryRun时只输出命令
+func runCommand(command ...string) error {
+	if DryRun {
+		Log.Log.Println("dry-run：" + strings.Join(command, " "))
+		return nil
+	}
+	output, err := exec.Command(command[0], command[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s：%w %s", command[0], err, strings.TrimSpace(string(output)))
+	}
+	return nil
 }
@@ -10,6 +10,15 @@ import (
 	"unsafe"
 )
 
+// linux系统根目录,所有读写的路径都以它为前缀,测试时可以指向临时目录
+var SystemRoot = "/"
+
+// linux系统只写入文件,不执行更新证书的命令
+var DryRun = false
+
+// 安装到系统和NSS数据库中的证书名称
+var CertName = "shermie-proxy"
+
 func FileExist(file string) bool {
 	_, err := os.Stat(file)
 	if err != nil {
@@ -5,6 +5,7 @@ package Utils
 
 import (
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"golang.org/x/sys/windows"
 	"os"
@@ -120,3 +121,7 @@ func SetSystemProxy(proxy string) error {
 	}
 	return nil
 }
+
+func UninstallCert() error {
+	return errors.New("windows系统请在certmgr.msc中手动删除证书")
+}
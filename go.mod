@@ -1,8 +1,21 @@
 module github.com/k8scat/shermie-proxy
 
-go 1.16
+go 1.22
 
 require (
-	github.com/viki-org/dnscache v0.0.0-20130720023526-c70c1f23c5d8 // indirect
-	golang.org/x/sys v0.6.0 // indirect
+	github.com/andybalholm/brotli v1.0.5
+	github.com/dop251/goja v0.0.0-20241024094426-79f3a7efcdbd
+	github.com/klauspost/compress v1.18.0
+	golang.org/x/crypto v0.23.0
+	golang.org/x/net v0.25.0
+	golang.org/x/sys v0.20.0
+	google.golang.org/protobuf v1.34.2
+	software.sslmate.com/src/go-pkcs12 v0.4.0
+)
+
+require (
+	github.com/dlclark/regexp2 v1.11.4 // indirect
+	github.com/go-sourcemap/sourcemap v2.1.3+incompatible // indirect
+	github.com/google/pprof v0.0.0-20230207041349-798e818bf904 // indirect
+	golang.org/x/text v0.15.0 // indirect
 )